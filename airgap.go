@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/schollz/progressbar/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const bundleDownloadURL = "https://downloads.d2iq.com/dkp/"
+
+// Collect everything an air gapped site needs to run pkd up into a single tar.gz bundle
+func airgap() {
+
+	cluster := loadCluster()
+	fmt.Fprintf(console, "Cluster YAML loaded into PKD\n")
+
+	version := cluster.MetaData.DKPversion
+	ag := cluster.AirGap
+	if ag.OsVersion == "" || ag.ContainerdVersion == "" {
+		fmt.Fprintln(console, "airgap.osversion and airgap.containerdversion must be set in cluster.yaml! Exiting!")
+		return
+	}
+	//the bundle is built for the versions in cluster.yaml, so they must be ones the cluster can use
+	if !checkCluster(cluster) {
+		return
+	}
+	k8sVersion := artifactK8sVersion(cluster.MetaData.K8sVersion)
+
+	//the dkp cli is not part of the air gap bundle, it must already be in the working directory
+	if _, err := os.Stat("dkp"); err != nil {
+		fmt.Fprintln(console, "DKP Binary not present! Exiting!")
+		return
+	}
+
+	//grab the DKP Air Gap Bundle if it hasn't already been unzipped to the current directory
+	bundle := bundleDir(version)
+	if stat, err := os.Stat(bundle); err != nil || !stat.IsDir() {
+		archive := "dkp-air-gapped-bundle_" + version + "_linux_amd64.tar.gz"
+		if _, err := os.Stat(archive); err != nil {
+			download(bundleDownloadURL+version+"/"+archive, archive)
+		}
+		fmt.Fprintln(console, "Unpacking "+archive)
+		err = decompress(archive, ".")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//konvoy image builder and only the os artifacts needed for this cluster
+	kibDir := bundle + "kib"
+	artifacts := map[string]bool{
+		osPackagesBundle(k8sVersion, ag.OsVersion): true,
+		containerdBundle(ag.ContainerdVersion):     true,
+		"pip-packages.tar.gz":                      true,
+	}
+	bundles := []string{
+		"konvoy-image-bundle.tar.gz",
+		"kommander-image-bundle-" + version + ".tar.gz",
+		"dkp-insights-image-bundle-" + version + ".tar.gz",
+	}
+
+	//check for everything we need before copying gigabytes of it into the staging directory
+	for _, artifact := range sortedBoolKeys(artifacts) {
+		if _, err := os.Stat(kibDir + "/artifacts/" + artifact); err != nil {
+			fmt.Fprintln(console, "Could not find "+artifact+" in the Air Gap Bundle, check the airgap section of cluster.yaml! Exiting!")
+			return
+		}
+	}
+	required := []string{
+		bundle + "konvoy-bootstrap_image-" + version + ".tar",
+		bundle + "application-repositories/kommander-applications-" + version + ".tar.gz",
+		bundle + "application-charts/dkp-kommander-charts-bundle-" + version + ".tar.gz",
+	}
+	for _, b := range bundles {
+		required = append(required, bundle+"container-images/"+b)
+	}
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			fmt.Fprintln(console, "Could not find "+path+" in the Air Gap Bundle! Exiting!")
+			return
+		}
+	}
+
+	staging := "AirGapBundle-dkp-" + version
+	os.RemoveAll(staging)
+	os.MkdirAll(staging, os.ModePerm)
+	fmt.Fprintf(console, "Created staging directory "+staging+"\n")
+
+	manifest := airGapManifest{
+		PKDVersion:        pkdVersion,
+		DKPVersion:        version,
+		K8sVersion:        k8sVersion,
+		OsVersion:         ag.OsVersion,
+		ContainerdVersion: ag.ContainerdVersion,
+	}
+
+	//DKP cli
+	stageFile("dkp", staging+"/dkp", &manifest)
+
+	err := filepath.Walk(kibDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(kibDir, path)
+		if err != nil {
+			return err
+		}
+		//artifacts/images/ holds the kubernetes images and is always needed, skip bundles for other os and k8s versions
+		if filepath.Dir(rel) == "artifacts" && !artifacts[filepath.Base(rel)] {
+			return nil
+		}
+		stageFile(path, staging+"/"+path, &manifest)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//bootstrap image and the image bundles pushed by seedRegistry
+	stageFile(bundle+"konvoy-bootstrap_image-"+version+".tar", staging+"/"+bundle+"konvoy-bootstrap_image-"+version+".tar", &manifest)
+	for _, b := range bundles {
+		stageFile(bundle+"container-images/"+b, staging+"/"+bundle+"container-images/"+b, &manifest)
+	}
+
+	//kommander is installed from the working directory after pkd up finishes
+	stageFile(bundle+"application-repositories/kommander-applications-"+version+".tar.gz", staging+"/kommander-applications-"+version+".tar.gz", &manifest)
+	stageFile(bundle+"application-charts/dkp-kommander-charts-bundle-"+version+".tar.gz", staging+"/dkp-kommander-charts-bundle-"+version+".tar.gz", &manifest)
+
+	if ag.IncludePKD {
+		pkdOS := ag.PKDoS
+		if pkdOS == "" {
+			pkdOS = runtime.GOOS
+		}
+		//prefer a pkd binary built for the target os, otherwise use this one if it will run there
+		if _, err := os.Stat("pkd-" + pkdOS); err == nil {
+			stageFile("pkd-"+pkdOS, staging+"/pkd", &manifest)
+		} else if pkdOS == runtime.GOOS {
+			self, err := os.Executable()
+			if err != nil {
+				log.Fatal(err)
+			}
+			stageFile(self, staging+"/pkd", &manifest)
+		} else {
+			fmt.Fprintln(console, "Could not find pkd-"+pkdOS+" in the current directory, skipping pkd binary")
+		}
+	}
+
+	cfg, err := os.ReadFile("cluster.yaml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(staging+"/cluster.yaml", cfg, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	data, err := yaml.Marshal(&manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(staging+"/manifest.yaml", data, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(console, "Wrote manifest of %d files to %s/manifest.yaml\n", len(manifest.Files), staging)
+
+	compress(staging, version)
+}
+
+// copy a file into the staging directory, keeping its permissions, and record it in the manifest
+func stageFile(src string, dst string, manifest *airGapManifest) {
+
+	info, err := os.Stat(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = copy(src, dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Chmod(dst, info.Mode().Perm())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file, err := os.Open(dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		log.Fatal(err)
+	}
+
+	//paths in the manifest are relative to the root of the extracted bundle
+	name := strings.TrimPrefix(filepath.ToSlash(dst), "AirGapBundle-dkp-"+manifest.DKPVersion+"/")
+	manifest.Files = append(manifest.Files, airGapFile{
+		Path:   name,
+		Size:   info.Size(),
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	})
+	fmt.Fprintln(console, "Staged "+name)
+}
+
+func download(url string, dst string) {
+
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("Failed to download " + url + ": " + resp.Status)
+	}
+
+	//write to a temporary file so an interrupted download is never mistaken for a complete one
+	file, err := os.Create(dst + ".part")
+	if err != nil {
+		log.Fatal(err)
+	}
+	bar := progressbar.DefaultBytes(
+		resp.ContentLength,
+		"Downloading "+filepath.Base(dst),
+	)
+	_, err = io.Copy(io.MultiWriter(file, bar), resp.Body)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Rename(dst+".part", dst)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// where konvoy-image keeps the artifacts it uploads, relative to the kib directory
+const kibArtifactsDir = "artifacts"
+
+// os packages bundle uploaded to the hosts by konvoy-image, ie 1.26.6_centos_7_x86_64.tar.gz
+func osPackagesBundle(k8sVersion string, osVersion string) string {
+	return k8sVersion + "_" + osVersion + ".tar.gz"
+}
+
+// containerd bundle uploaded to the hosts by konvoy-image, ie containerd-1.4.13-d2iq.1-centos-7.9-x86_64.tar.gz
+func containerdBundle(containerdVersion string) string {
+	return "containerd-1.4.13-d2iq.1-" + containerdVersion + ".tar.gz"
+}
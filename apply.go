@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// field manager pkd owns its fields under when applying resources
+const fieldManager = "pkd"
+
+// Server side apply every object in a manifest so pkd up can be rerun against objects that already exist.
+// Server side apply also has no size limit from the last-applied annotation, which tigera's ConfigMap exceeds
+func applyFile(client kubeAPI, path string) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	decoder := yamlutil.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		err := decoder.Decode(&obj.Object)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(path + ": " + err.Error())
+		}
+		//empty documents between ---
+		if len(obj.Object) == 0 {
+			continue
+		}
+		status, err := client.apply(obj)
+		if err != nil {
+			log.Fatal(path + ": " + err.Error())
+		}
+		fmt.Fprintln(console, strings.ToLower(obj.GetKind())+"/"+obj.GetName()+" "+status)
+	}
+}
+
+// apply a single object and report whether it was created, configured or unchanged
+func (c *kubeClient) apply(obj *unstructured.Unstructured) (string, error) {
+
+	resource, err := c.resourceFor(obj)
+	if err != nil {
+		return "", err
+	}
+
+	before := ""
+	existing, err := resource.Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+	if err == nil {
+		before = existing.GetResourceVersion()
+	} else if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	body, err := obj.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+	force := true
+	applied, err := resource.Patch(context.TODO(), obj.GetName(), types.ApplyPatchType, body, metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	//the resource version only changes when the apply changed something
+	switch {
+	case before == "":
+		return "created", nil
+	case before == applied.GetResourceVersion():
+		return "unchanged", nil
+	default:
+		return "configured", nil
+	}
+}
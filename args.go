@@ -0,0 +1,64 @@
+package main
+
+import "strings"
+
+// kubeadm extraArgs keys are flag names without the leading --
+func argName(flag string) string {
+	return strings.TrimPrefix(flag, "--")
+}
+
+// the flags pkd sets with anything cluster.yaml sets on top, cluster.yaml wins
+func mergeArgs(defaults map[string]string, overrides map[string]string) map[string]string {
+
+	args := map[string]string{}
+	for key, value := range defaults {
+		args[key] = value
+	}
+	for key, value := range overrides {
+		args[argName(key)] = value
+	}
+	return args
+}
+
+// kubelet flags for every node in a pool
+func kubeletArgs(pool NodePool) map[string]string {
+
+	defaults := map[string]string{
+		"cloud-provider":    "",
+		"provider-id":       "'{{ .ProviderID }}'",
+		"volume-plugin-dir": "/usr/libexec/kubernetes/kubelet-plugins/volume/exec/",
+	}
+	if len(pool.Labels) > 0 {
+		defaults["node-labels"] = nodeLabels(pool.Labels)
+	}
+	return mergeArgs(defaults, pool.KubeletExtraArgs)
+}
+
+// where the oidc ca is written on the control planes and mounted into the api server
+const oidcCADir = "/etc/kubernetes/oidc"
+
+// api server flags for the oidc block of cluster.yaml, none when it isn't configured
+func oidcArgs(oidc OIDC) map[string]string {
+
+	args := map[string]string{}
+	if oidc.IssuerURL == "" {
+		return args
+	}
+	args["oidc-issuer-url"] = oidc.IssuerURL
+	args["oidc-client-id"] = oidc.ClientID
+	optional := map[string]string{
+		"oidc-username-claim":  oidc.UsernameClaim,
+		"oidc-username-prefix": oidc.UsernamePrefix,
+		"oidc-groups-claim":    oidc.GroupsClaim,
+		"oidc-groups-prefix":   oidc.GroupsPrefix,
+	}
+	for key, value := range optional {
+		if value != "" {
+			args[key] = value
+		}
+	}
+	if oidc.CAFile != "" {
+		args["oidc-ca-file"] = oidcCADir + "/ca.crt"
+	}
+	return args
+}
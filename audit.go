@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// the audit policy and webhook config are written into the directory mounted into the api server
+const auditPolicyDir = "/etc/kubernetes/audit-policy"
+
+// The fields of an audit.k8s.io/v1 Policy, decoded strictly so a typo in cluster.yaml's
+// policy fails validation instead of being silently ignored by the api server.
+// Metadata is an ordinary ObjectMeta the api server doesn't use, so it is accepted as is
+type auditPolicy struct {
+	APIVersion        string                 `yaml:"apiVersion"`
+	Kind              string                 `yaml:"kind"`
+	Metadata          map[string]interface{} `yaml:"metadata"`
+	Rules             []auditRule            `yaml:"rules"`
+	OmitStages        []string               `yaml:"omitStages"`
+	OmitManagedFields bool                   `yaml:"omitManagedFields"`
+}
+type auditRule struct {
+	Level      string   `yaml:"level"`
+	Users      []string `yaml:"users"`
+	UserGroups []string `yaml:"userGroups"`
+	Verbs      []string `yaml:"verbs"`
+	Resources  []struct {
+		Group         string   `yaml:"group"`
+		Resources     []string `yaml:"resources"`
+		ResourceNames []string `yaml:"resourceNames"`
+	} `yaml:"resources"`
+	Namespaces        []string `yaml:"namespaces"`
+	NonResourceURLs   []string `yaml:"nonResourceURLs"`
+	OmitStages        []string `yaml:"omitStages"`
+	OmitManagedFields *bool    `yaml:"omitManagedFields"`
+}
+
+var goTypeSuffix = regexp.MustCompile(` in type main\.\w+`)
+
+var auditLevels = map[string]bool{"None": true, "Metadata": true, "Request": true, "RequestResponse": true}
+var auditStages = map[string]bool{"RequestReceived": true, "ResponseStarted": true, "ResponseComplete": true, "Panic": true}
+
+// every problem with an audit policy, none if the api server will accept it
+func checkAuditPolicy(data []byte) []string {
+
+	policy := auditPolicy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&policy)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		//yaml names our go types, ie field verb not found in type main.auditRule
+		problems := []string{}
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, goTypeSuffix.ReplaceAllString(msg, ""))
+		}
+		return problems
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+	problems := []string{}
+	if policy.APIVersion != "audit.k8s.io/v1" || policy.Kind != "Policy" {
+		problems = append(problems, fmt.Sprintf("must be an audit.k8s.io/v1 Policy, not %s %s", policy.APIVersion, policy.Kind))
+	}
+	if len(policy.Rules) == 0 {
+		problems = append(problems, "at least one rule is required")
+	}
+	checkStages := func(path string, stages []string) {
+		for _, stage := range stages {
+			if !auditStages[stage] {
+				problems = append(problems, fmt.Sprintf("%s: %q is not an audit stage", path, stage))
+			}
+		}
+	}
+	checkStages("omitStages", policy.OmitStages)
+	for i, rule := range policy.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		if !auditLevels[rule.Level] {
+			problems = append(problems, fmt.Sprintf("%s.level: %q must be one of None, Metadata, Request or RequestResponse", path, rule.Level))
+		}
+		if len(rule.NonResourceURLs) > 0 && (len(rule.Resources) > 0 || len(rule.Namespaces) > 0) {
+			problems = append(problems, path+": nonResourceURLs cannot be combined with resources or namespaces")
+		}
+		checkStages(path+".omitStages", rule.OmitStages)
+	}
+	return problems
+}
+
+// the webhook config may hold the audit backend's credentials, so it is kept in a secret
+func auditWebhookSecretName(clusterName string) string {
+	return clusterName + "-audit-webhook-config"
+}
+
+// the webhook config is a kubeconfig pointing at the audit backend
+func checkAuditWebhookConfig(data []byte) error {
+	_, err := clientcmd.Load(data)
+	return err
+}
+
+// api server flags for the audit section of cluster.yaml
+func auditArgs(audit Audit) map[string]string {
+
+	//0 is a valid setting that turns the limit off, only a missing value keeps pkd's default
+	retention := func(value *int, fallback string) string {
+		if value == nil {
+			return fallback
+		}
+		return strconv.Itoa(*value)
+	}
+	args := map[string]string{
+		"audit-log-maxage":    retention(audit.MaxAge, "30"),
+		"audit-log-maxbackup": retention(audit.MaxBackup, "10"),
+		"audit-log-maxsize":   retention(audit.MaxSize, "100"),
+		"audit-log-path":      "/var/log/audit/kube-apiserver-audit.log",
+		"audit-policy-file":   auditPolicyDir + "/apiserver-audit-policy.yaml",
+	}
+	if audit.WebhookConfigFile != "" {
+		args["audit-webhook-config-file"] = auditPolicyDir + "/webhook-config.yaml"
+		if audit.WebhookMode != "" {
+			args["audit-webhook-mode"] = audit.WebhookMode
+		}
+	}
+	return args
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Tear down the cluster described by cluster.yaml, the inverse of pkd up
+func down(args []string) {
+
+	flags := flag.NewFlagSet("down", flag.ExitOnError)
+	clean := flags.Bool("clean", false, "also delete <name>.conf, resources/ and overrides/")
+	yes := flags.Bool("yes", false, "do not ask for confirmation")
+	flags.Parse(args)
+
+	cluster := loadCluster()
+	fmt.Fprintf(console, "Cluster YAML loaded into PKD\n")
+	clusterName := cluster.MetaData.Name
+	kubeconfig := clusterName + ".conf"
+
+	if _, err := os.Stat("dkp"); err != nil {
+		fmt.Fprintln(console, "DKP Binary not present! Exiting!")
+		return
+	}
+
+	if !*yes {
+		r := bufio.NewReader(os.Stdin)
+		fmt.Fprintf(console, "This will delete cluster "+clusterName+" and wipe its hosts. Type the cluster name to confirm: ")
+		res, err := r.ReadString('\n')
+		if err != nil {
+			log.Fatal(err)
+		}
+		if strings.TrimSpace(res) != clusterName {
+			fmt.Fprintln(console, "Cluster name did not match, Exiting!")
+			return
+		}
+	}
+
+	//after pivotCluster the cluster manages itself, so its CAPI objects have to be moved back to a bootstrap cluster first
+	//a cluster that can't be reached may still exist, so stop before its kubeconfig and files are removed
+	selfManaged, err := clusterExists(clusterName, kubeconfig)
+	if err != nil {
+		log.Fatal("Could not check whether " + clusterName + " is self managed using " + kubeconfig + ": " + err.Error())
+	}
+	if selfManaged {
+		fmt.Fprintln(console, "Cluster "+clusterName+" is self managed, moving CAPI resources to a new bootstrap cluster")
+		bootstrap("down")
+		bootstrap("up")
+		moveToBootstrap(kubeconfig)
+		fmt.Fprintf(console, "Moved CAPI resources to the Bootstrap Cluster\n")
+	}
+
+	bootstrapped, err := clusterExists(clusterName, bootstrapKubeconfig)
+	if err != nil {
+		log.Fatal("Could not check for cluster " + clusterName + " in the bootstrap cluster using " + bootstrapKubeconfig + ": " + err.Error())
+	}
+	if bootstrapped {
+		deleteCluster(clusterName)
+		fmt.Fprintf(console, "Deleted Cluster "+clusterName+"\n")
+		waitForMachinesDeleted(clusterName)
+		fmt.Fprintf(console, "All Machines Cleaned Up\n")
+		bootstrap("down")
+		fmt.Fprintf(console, "Cleaned up the Bootstrap Cluster\n")
+	} else {
+		fmt.Fprintln(console, "Could not find cluster "+clusterName+" in the workload or bootstrap cluster, skipping deletion")
+	}
+
+	if _, err := os.Stat(kubeconfig); err == nil {
+		unmergeKubeconfig(kubeconfig)
+		fmt.Fprintf(console, "Removed "+clusterName+" from ~/.kube/config\n")
+	}
+
+	if *clean {
+		for _, path := range []string{kubeconfig, defaultOutput.ResourcesDir, defaultOutput.OverridesDir} {
+			err := os.RemoveAll(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintln(console, "Deleted "+path)
+		}
+	}
+}
+
+func moveToBootstrap(kubeconfig string) {
+
+	// ./dkp move capi-resources --from-kubeconfig ${CLUSTER_NAME}.conf --to-kubeconfig .pkd/bootstrap.conf
+	run(newCommand("./dkp", "move", "capi-resources", "--from-kubeconfig", kubeconfig, "--to-kubeconfig", bootstrapKubeconfig))
+}
+
+func deleteCluster(clusterName string) {
+
+	// ./dkp delete cluster --cluster-name ${CLUSTER_NAME} --kubeconfig .pkd/bootstrap.conf
+	run(newCommand("./dkp", "delete", "cluster", "--cluster-name", clusterName, "--kubeconfig", bootstrapKubeconfig))
+}
+
+func waitForMachinesDeleted(clusterName string) {
+
+	fmt.Fprintf(console, "Waiting up to 1 hour for all machines to be cleaned up\nTo check on your machines, use command:\n\n  kubectl --kubeconfig "+bootstrapKubeconfig+" get job,pod,machines\n\n")
+	//kubectl wait --for=delete machines -l cluster.x-k8s.io/cluster-name=${CLUSTER_NAME} --timeout=60m
+	err := mustKubeClient(bootstrapKubeconfig).waitForMachinesDeleted(clusterName, time.Hour)
+	if err != nil {
+		log.Fatal("Machines were not cleaned up: " + err.Error())
+	}
+}
+
+// remove the contexts, users and clusters that mergeKubeconfig copied into ~/.kube/config
+func unmergeKubeconfig(kubeconfig string) {
+
+	merged := loadDefaultKubeconfig()
+	config, err := clientcmd.LoadFromFile(kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//anything already removed by hand is simply skipped
+	for name := range config.Clusters {
+		delete(merged.Clusters, name)
+	}
+	for name := range config.AuthInfos {
+		delete(merged.AuthInfos, name)
+	}
+	for name := range config.Contexts {
+		delete(merged.Contexts, name)
+	}
+	if _, ok := merged.Contexts[merged.CurrentContext]; !ok {
+		merged.CurrentContext = ""
+	}
+
+	err = clientcmd.WriteToFile(*merged, defaultKubeconfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
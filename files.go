@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The files cluster.yaml adds to a pool, as they appear in a kubeadm config spec.
+// Local files are read in now so the rendered objects don't depend on the working directory
+func poolFiles(pool NodePool) []KubeadmFile {
+
+	files := []KubeadmFile{}
+	for _, file := range pool.Files {
+		kf := KubeadmFile{Path: file.Path, Permissions: file.Permissions, Owner: file.Owner, Content: file.Content}
+		if kf.Permissions == "" {
+			kf.Permissions = "0644"
+		}
+		if file.File != "" {
+			kf.Content = readLocalFile(file.File)
+		}
+		if file.Secret != nil {
+			kf.ContentFrom.Secret.Name = file.Secret.Name
+			kf.ContentFrom.Secret.Key = file.Secret.Key
+		}
+		files = append(files, kf)
+	}
+	return files
+}
+
+// content of a local file cluster.yaml refers to, validateCluster has already checked it can be read
+func readLocalFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(data)
+}
+
+// files pkd writes on the nodes of every pool
+var pkdFiles = []string{
+	"/run/kubeadm/konvoy-set-kube-proxy-configuration.sh",
+	"/etc/containerd/conf.d/konvoy-metrics.toml",
+	"/run/konvoy/containerd-apply-patches.sh",
+	"/run/konvoy/restart-containerd-and-wait.sh",
+	"/run/konvoy/install-kubelet-credential-providers.sh",
+	"/etc/kubernetes/pki/encryption-config.yaml",
+}
+
+// Paths a pool file must not be written to because pkd writes them itself for this cluster.
+// Directories are returned with a trailing slash, everything under them belongs to pkd
+func reservedFilePaths(cluster pkdCluster) []string {
+
+	paths := append([]string{}, pkdFiles...)
+	paths = append(paths, auditPolicyDir+"/", oidcCADir+"/")
+	if proxyEnabled(cluster.Proxy) {
+		for _, service := range []string{"containerd", "kubelet"} {
+			paths = append(paths, "/etc/systemd/system/"+service+".service.d/http-proxy.conf")
+		}
+	}
+	for _, registry := range clusterRegistries(cluster) {
+		//validateCluster reports registries that can't be parsed on their own
+		if endpoint, err := parseRegistry(registry.Host); err == nil && registryTLSEnabled(registry) {
+			paths = append(paths, registryCertsDir(endpoint)+"/")
+			for _, mirrored := range registry.Mirrors {
+				paths = append(paths, mirrorCertsDir(mirrored)+"/")
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// the reserved path a pool file would overwrite, empty if it doesn't clash with any
+func reservedFilePath(cluster pkdCluster, path string) string {
+
+	for _, reserved := range reservedFilePaths(cluster) {
+		if path == reserved || path+"/" == reserved || (strings.HasSuffix(reserved, "/") && strings.HasPrefix(path, reserved)) {
+			return reserved
+		}
+	}
+	return ""
+}
+
+// Secrets a pool file reads from are not created by pkd, this lists them so they are not missed
+func secretFileNotes(cluster pkdCluster) []string {
+
+	notes := []string{}
+	note := func(prefix string, pool NodePool) {
+		for i, file := range pool.Files {
+			if file.Secret != nil {
+				notes = append(notes, fmt.Sprintf("%s.files[%d] reads %s from Secret %q, create it in the default namespace of the bootstrap cluster with the clusterctl.cluster.x-k8s.io/move label before deploying", prefix, i, file.Path, file.Secret.Name))
+			}
+		}
+	}
+	note("controlplane", cluster.Controlplane)
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		note("nodepools."+poolName, cluster.NodePools[poolName])
+	}
+	return notes
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-func generateCalicoConfigMap(cluster pkdCluster) {
+// calico-cni-installation-${cluster_name}-ConfigMap.yaml
+func generateCalicoConfigMap(cluster pkdCluster) []byte {
 
 	customResources :=
 		"apiVersion: operator.tigera.io/v1\n" +
@@ -37,10 +37,5 @@ func generateCalicoConfigMap(cluster pkdCluster) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	//calico-cni-installation-${cluster_name}-ConfigMap.yaml
-	err = os.WriteFile("resources/calico-cni-installation-"+cluster.MetaData.Name+"-ConfigMap.yaml", file, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+	return file
 }
@@ -2,12 +2,12 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-func generateCapiCluster(cluster pkdCluster) {
+// ${CLUSTER_NAME}-Cluster.yaml
+func generateCapiCluster(cluster pkdCluster) []byte {
 
 	capppCluster := capiCluster{
 		APIVersion: "",
@@ -64,8 +64,8 @@ func generateCapiCluster(cluster pkdCluster) {
 	capppCluster.Metadata.Namespace = "default"
 	capppCluster.Spec.ClusterNetwork.Pods.CidrBlocks = append(capppCluster.Spec.ClusterNetwork.Pods.CidrBlocks, cluster.MetaData.PodSubnet)
 	capppCluster.Spec.ClusterNetwork.Services.CidrBlocks = append(capppCluster.Spec.ClusterNetwork.Services.CidrBlocks, cluster.MetaData.ServiceSubnet)
-	capppCluster.Spec.ControlPlaneEndpoint.Host = ""
-	capppCluster.Spec.ControlPlaneEndpoint.Port = 0
+	capppCluster.Spec.ControlPlaneEndpoint.Host = cluster.ControlPlaneEndpoint.Host
+	capppCluster.Spec.ControlPlaneEndpoint.Port = cluster.ControlPlaneEndpoint.Port
 	capppCluster.Spec.ControlPlaneRef.APIVersion = "controlplane.cluster.x-k8s.io/v1beta1"
 	capppCluster.Spec.ControlPlaneRef.Kind = "KubeadmControlPlane"
 	capppCluster.Spec.ControlPlaneRef.Name = cluster.MetaData.Name + "-control-plane"
@@ -79,10 +79,5 @@ func generateCapiCluster(cluster pkdCluster) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	//${CLUSTER_NAME}-Cluster.yaml
-	err = os.WriteFile("resources/"+cluster.MetaData.Name+"-Cluster.yaml", file, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-
+	return file
 }
@@ -2,15 +2,13 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-func generateControlPlanePreprovisionedMachineTemplate(cluster pkdCluster) {
+func generateControlPlanePreprovisionedMachineTemplate(cluster pkdCluster) []byte {
 
 	nodesetName := "control-plane"
-	nodes := cluster.Controlplane
 	pmt := PreprovisionedMachineTemplate{}
 	pmt.APIVersion = "infrastructure.cluster.konvoy.d2iq.io/v1alpha1"
 	pmt.Kind = "PreprovisionedMachineTemplate"
@@ -18,16 +16,11 @@ func generateControlPlanePreprovisionedMachineTemplate(cluster pkdCluster) {
 	pmt.Metadata.Namespace = "default"
 	pmt.Spec.Template.Spec.InventoryRef.Name = cluster.MetaData.Name + "-" + nodesetName
 	pmt.Spec.Template.Spec.InventoryRef.Namespace = "default"
-	pmt.Spec.Template.Spec.OverrideRef.Name = cluster.MetaData.Name + "-control-plane-override"
-
-	genOverride2_6_0(pmt.Spec.Template.Spec.OverrideRef.Name, nodes, cluster.Registry, cluster.AirGap.Enabled)
+	pmt.Spec.Template.Spec.OverrideRef.Name = overrideName(cluster.MetaData.Name, nodesetName)
 
 	data, err := yaml.Marshal(&pmt)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = os.WriteFile("resources/"+cluster.MetaData.Name+"-"+nodesetName+"-PreprovisionedMachineTemplate.yaml", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return data
 }
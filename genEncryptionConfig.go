@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ${CLUSTER_NAME}-etcd-encryption-config is mounted by the KubeadmControlPlane as the apiserver's encryption-provider-config
+func encryptionSecretName(clusterName string) string {
+	return clusterName + "-etcd-encryption-config"
+}
+
+// where the key generated for a cluster is kept, so every render and resumed pkd up reuses it
+func generatedKeyPath(clusterName string) string {
+	return filepath.Join(stateDir, clusterName+"-encryption-key")
+}
+
+// Generate an aescbc EncryptionConfiguration for the cluster, or reuse the key from
+// metadata.encryptionkeyfile when rebuilding a cluster from an existing etcd backup.
+// A generated key is saved on first use, a new key under a running cluster would leave
+// etcd unreadable for every control plane that joins afterwards
+func generateEncryptionConfig(cluster pkdCluster) []byte {
+
+	keyFile := cluster.MetaData.EncryptionKeyFile
+	if keyFile == "" {
+		keyFile = generatedKeyPath(cluster.MetaData.Name)
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			saveGeneratedKey(keyFile)
+		}
+	}
+	config, err := loadEncryptionConfig(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return generateSecret(cluster.MetaData.Name, encryptionSecretName(cluster.MetaData.Name), map[string][]byte{"value": config})
+}
+
+func saveGeneratedKey(path string) {
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(console, "Generated a new etcd encryption key in "+path+", keep it to rebuild this cluster from an etcd backup")
+}
+
+// the key file holds either a complete EncryptionConfiguration or a base64 encoded 32 byte aescbc key
+func loadEncryptionConfig(path string) ([]byte, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := encryptionConfiguration{}
+	if err := yaml.Unmarshal(data, &existing); err == nil && existing.Kind == "EncryptionConfiguration" {
+		if existing.APIVersion != "apiserver.config.k8s.io/v1" || len(existing.Resources) == 0 {
+			return nil, fmt.Errorf("%s is not a valid apiserver.config.k8s.io/v1 EncryptionConfiguration", path)
+		}
+		return data, nil
+	}
+
+	secret := string(bytes.TrimSpace(data))
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must contain an EncryptionConfiguration or a base64 encoded 32 byte key", path)
+	}
+	return encryptionConfig(secret), nil
+}
+
+func encryptionConfig(secret string) []byte {
+
+	config := encryptionConfiguration{}
+	config.APIVersion = "apiserver.config.k8s.io/v1"
+	config.Kind = "EncryptionConfiguration"
+	config.Resources = append(config.Resources, encryptionResource{
+		Resources: []string{"secrets"},
+		Providers: []map[string]interface{}{
+			{
+				"aescbc": map[string]interface{}{
+					"keys": []map[string]string{
+						{"name": "key1", "secret": secret},
+					},
+				},
+			},
+			//identity lets the apiserver read anything written before encryption was enabled
+			{"identity": map[string]interface{}{}},
+		},
+	})
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return data
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"log"
 	"os"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
+// ansible inventory konvoy-image uses to upload the air gap artifacts, it is written to the kib
+// directory of the bundle next to the ssh keys the seed phase copies there
 func generateInventory(cluster pkdCluster) {
 
 	clusterInventory := Inventory{
@@ -23,19 +26,25 @@ func generateInventory(cluster pkdCluster) {
 	clusterInventory.All.Hosts = map[string]AnsibleHost{}
 	clusterInventory.All.Vars.AnsibleUser = cluster.MetaData.SshUser
 	clusterInventory.All.Vars.AnsiblePort = 22
-	clusterInventory.All.Vars.AnsibleSSHPrivateKeyFile = cluster.MetaData.SshPrivateKey
+	clusterInventory.All.Vars.AnsibleSSHPrivateKeyFile = filepath.Base(cluster.MetaData.SshPrivateKey)
 
-	for _, ip := range cluster.Controlplane.Hosts {
-		node := AnsibleHost{}
-		node.AnsibleHost = ip
-		clusterInventory.All.Hosts[ip] = node
-
-	}
-	for _, npool := range cluster.NodePools {
-		for _, ip := range npool.Hosts {
+	for _, npool := range allPools(cluster) {
+		for _, name := range orderedHosts(npool) {
+			host := npool.Hosts[name]
 			node := AnsibleHost{}
-			node.AnsibleHost = ip
-			clusterInventory.All.Hosts[ip] = node
+			node.AnsibleHost = host.Address
+			//hosts in other security zones may need their own port, user or key
+			ssh := hostSSH(cluster.MetaData, host)
+			if ssh.User != clusterInventory.All.Vars.AnsibleUser {
+				node.AnsibleUser = ssh.User
+			}
+			if ssh.Port != clusterInventory.All.Vars.AnsiblePort {
+				node.AnsiblePort = ssh.Port
+			}
+			if key := filepath.Base(ssh.PrivateKey); key != clusterInventory.All.Vars.AnsibleSSHPrivateKeyFile {
+				node.AnsibleSSHPrivateKeyFile = key
+			}
+			clusterInventory.All.Hosts[host.Address] = node
 		}
 
 	}
@@ -44,8 +53,7 @@ func generateInventory(cluster pkdCluster) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	os.MkdirAll("kib", os.ModePerm)
-	err = os.WriteFile("kib/inventory.yaml", file, 0644)
+	err = os.WriteFile(bundleDir(cluster.MetaData.DKPversion)+"kib/inventory.yaml", file, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
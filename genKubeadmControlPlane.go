@@ -2,27 +2,26 @@ package main
 
 import (
 	"log"
-	"os"
 	"strconv"
 
 	"gopkg.in/yaml.v3"
 )
 
 // if 1 CP use alternate structure, otherwise just generate from defaults
-func generateKubeadmControlPlane(cluster pkdCluster) {
+func generateKubeadmControlPlane(cluster pkdCluster) []byte {
 	controlPlaneReplicas := strconv.Itoa(len(cluster.Controlplane.Hosts))
 	kcp := KubeadmControlPlane{}
 	kcp.APIVersion = "controlplane.cluster.x-k8s.io/v1beta1"
 	kcp.Kind = "KubeadmControlPlane"
 	kcp.Metadata.Name = cluster.MetaData.Name + "-control-plane"
 	kcp.Metadata.Namespace = "default"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.AuditLogMaxage = "30"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.AuditLogMaxbackup = "10"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.AuditLogMaxsize = "100"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.AuditLogPath = "/var/log/audit/kube-apiserver-audit.log"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.AuditPolicyFile = "/etc/kubernetes/audit-policy/apiserver-audit-policy.yaml"
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.CloudProvider = ""
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs.EncryptionProviderConfig = "/etc/kubernetes/pki/encryption-config.yaml"
+	apiServerArgs := mergeArgs(map[string]string{
+		"cloud-provider":             "",
+		"encryption-provider-config": "/etc/kubernetes/pki/encryption-config.yaml",
+	}, auditArgs(cluster.Audit))
+	apiServerArgs = mergeArgs(apiServerArgs, oidcArgs(cluster.OIDC))
+	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraArgs = mergeArgs(apiServerArgs, cluster.ExtraArgs.APIServer)
+	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.CertSANs = apiServerCertSANs(cluster)
 	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraVolumes = append(kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraVolumes,
 		struct {
 			HostPath  string "yaml:\"hostPath\""
@@ -45,17 +44,36 @@ func generateKubeadmControlPlane(cluster pkdCluster) {
 			Name:      "audit-logs",
 		})
 
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControllerManager.ExtraArgs.CloudProvider = ""
-	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControllerManager.ExtraArgs.FlexVolumePluginDir = "/usr/libexec/kubernetes/kubelet-plugins/volume/exec/"
+	if cluster.OIDC.CAFile != "" {
+		kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraVolumes = append(kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.APIServer.ExtraVolumes,
+			struct {
+				HostPath  string "yaml:\"hostPath\""
+				MountPath string "yaml:\"mountPath\""
+				Name      string "yaml:\"name\""
+			}{
+				HostPath:  oidcCADir,
+				MountPath: oidcCADir,
+				Name:      "oidc-ca",
+			})
+	}
+
+	kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.ControllerManager.ExtraArgs = mergeArgs(map[string]string{
+		"cloud-provider":         "",
+		"flex-volume-plugin-dir": "/usr/libexec/kubernetes/kubelet-plugins/volume/exec/",
+	}, cluster.ExtraArgs.ControllerManager)
+	if len(cluster.ExtraArgs.Scheduler) > 0 {
+		kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.Scheduler.ExtraArgs = mergeArgs(nil, cluster.ExtraArgs.Scheduler)
+	}
+	if len(cluster.ExtraArgs.Etcd) > 0 {
+		kcp.Spec.KubeadmConfigSpec.ClusterConfiguration.Etcd.Local.ExtraArgs = mergeArgs(nil, cluster.ExtraArgs.Etcd)
+	}
 	kcp.Spec.KubeadmConfigSpec.Format = "cloud-config"
 	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.CriSocket = "/run/containerd/containerd.sock"
-	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.KubeletExtraArgs.CloudProvider = ""
-	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.KubeletExtraArgs.ProviderID = "'{{ .ProviderID }}'"
-	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.KubeletExtraArgs.VolumePluginDir = "/usr/libexec/kubernetes/kubelet-plugins/volume/exec/"
+	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.KubeletExtraArgs = kubeletArgs(cluster.Controlplane)
+	kcp.Spec.KubeadmConfigSpec.InitConfiguration.NodeRegistration.Taints = poolTaints(cluster.Controlplane, true)
 	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.CriSocket = "/run/containerd/containerd.sock"
-	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.KubeletExtraArgs.CloudProvider = ""
-	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.KubeletExtraArgs.ProviderID = "'{{ .ProviderID }}'"
-	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.KubeletExtraArgs.VolumePluginDir = "/usr/libexec/kubernetes/kubelet-plugins/volume/exec/"
+	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.KubeletExtraArgs = kubeletArgs(cluster.Controlplane)
+	kcp.Spec.KubeadmConfigSpec.JoinConfiguration.NodeRegistration.Taints = poolTaints(cluster.Controlplane, true)
 	kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands = append(kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands,
 		"systemctl daemon-reload")
 	kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands = append(kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands,
@@ -66,7 +84,8 @@ func generateKubeadmControlPlane(cluster pkdCluster) {
 	kcp.Spec.MachineTemplate.InfrastructureRef.Kind = "PreprovisionedMachineTemplate"
 	kcp.Spec.MachineTemplate.InfrastructureRef.Name = cluster.MetaData.Name + "-control-plane"
 	kcp.Spec.MachineTemplate.InfrastructureRef.Namespace = "default"
-	kcp.Spec.Version = "v1.26.6"
+	kcp.Spec.MachineTemplate.Metadata.Labels = cluster.Controlplane.Labels
+	kcp.Spec.Version = poolK8sVersion(cluster, cluster.Controlplane)
 
 	if controlPlaneReplicas == "1" {
 		kcp.Spec.Replicas = 1
@@ -78,6 +97,9 @@ func generateKubeadmControlPlane(cluster pkdCluster) {
 	}
 
 	content1 := "# Taken from https://github.com/kubernetes/kubernetes/blob/master/cluster/gce/gci/configure-helper.sh\n# Recommended in Kubernetes docs\napiVersion: audit.k8s.io/v1\nkind: Policy\nrules:\n  # The following requests were manually identified as high-volume and low-risk,\n  # so drop them.\n  - level: None\n    users: [\"system:kube-proxy\"]\n    verbs: [\"watch\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"endpoints\", \"services\", \"services/status\"]\n  - level: None\n    # Ingress controller reads 'configmaps/ingress-uid' through the unsecured port.\n    # TODO(#46983): Change this to the ingress controller service account.\n    users: [\"system:unsecured\"]\n    namespaces: [\"kube-system\"]\n    verbs: [\"get\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"configmaps\"]\n  - level: None\n    users: [\"kubelet\"] # legacy kubelet identity\n    verbs: [\"get\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"nodes\", \"nodes/status\"]\n  - level: None\n    userGroups: [\"system:nodes\"]\n    verbs: [\"get\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"nodes\", \"nodes/status\"]\n  - level: None\n    users:\n      - system:kube-controller-manager\n      - system:kube-scheduler\n      - system:serviceaccount:kube-system:endpoint-controller\n    verbs: [\"get\", \"update\"]\n    namespaces: [\"kube-system\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"endpoints\"]\n  - level: None\n    users: [\"system:apiserver\"]\n    verbs: [\"get\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"namespaces\", \"namespaces/status\", \"namespaces/finalize\"]\n  - level: None\n    users: [\"cluster-autoscaler\"]\n    verbs: [\"get\", \"update\"]\n    namespaces: [\"kube-system\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"configmaps\", \"endpoints\"]\n  # Don't log HPA fetching metrics.\n  - level: None\n    users:\n      - system:kube-controller-manager\n    verbs: [\"get\", \"list\"]\n    resources:\n      - group: \"metrics.k8s.io\"\n  # Don't log these read-only URLs.\n  - level: None\n    nonResourceURLs:\n      - /healthz*\n      - /version\n      - /swagger*\n  # Don't log events requests.\n  - level: None\n    resources:\n      - group: \"\" # core\n        resources: [\"events\"]\n  # node and pod status calls from nodes are high-volume and can be large, don't log responses for expected updates from nodes\n  - level: Request\n    users: [\"kubelet\", \"system:node-problem-detector\", \"system:serviceaccount:kube-system:node-problem-detector\"]\n    verbs: [\"update\",\"patch\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"nodes/status\", \"pods/status\"]\n    omitStages:\n      - \"RequestReceived\"\n  - level: Request\n    userGroups: [\"system:nodes\"]\n    verbs: [\"update\",\"patch\"]\n    resources:\n      - group: \"\" # core\n        resources: [\"nodes/status\", \"pods/status\"]\n    omitStages:\n      - \"RequestReceived\"\n  # deletecollection calls can be large, don't log responses for expected namespace deletions\n  - level: Request\n    users: [\"system:serviceaccount:kube-system:namespace-controller\"]\n    verbs: [\"deletecollection\"]\n    omitStages:\n      - \"RequestReceived\"\n  # Secrets, ConfigMaps, and TokenReviews can contain sensitive & binary data,\n  # so only log at the Metadata level.\n  - level: Metadata\n    resources:\n      - group: \"\" # core\n        resources: [\"secrets\", \"configmaps\"]\n      - group: authentication.k8s.io\n        resources: [\"tokenreviews\"]\n    omitStages:\n      - \"RequestReceived\"\n  # Get responses can be large; skip them.\n  - level: Request\n    verbs: [\"get\", \"list\", \"watch\"]\n    resources:\n      - group: \"\" # core\n      - group: \"admissionregistration.k8s.io\"\n      - group: \"apiextensions.k8s.io\"\n      - group: \"apiregistration.k8s.io\"\n      - group: \"apps\"\n      - group: \"authentication.k8s.io\"\n      - group: \"authorization.k8s.io\"\n      - group: \"autoscaling\"\n      - group: \"batch\"\n      - group: \"certificates.k8s.io\"\n      - group: \"extensions\"\n      - group: \"metrics.k8s.io\"\n      - group: \"networking.k8s.io\"\n      - group: \"node.k8s.io\"\n      - group: \"policy\"\n      - group: \"rbac.authorization.k8s.io\"\n      - group: \"scheduling.k8s.io\"\n      - group: \"settings.k8s.io\"\n      - group: \"storage.k8s.io\"\n    omitStages:\n      - \"RequestReceived\"\n  # Default level for known APIs\n  - level: RequestResponse\n    resources:\n      - group: \"\" # core\n      - group: \"admissionregistration.k8s.io\"\n      - group: \"apiextensions.k8s.io\"\n      - group: \"apiregistration.k8s.io\"\n      - group: \"apps\"\n      - group: \"authentication.k8s.io\"\n      - group: \"authorization.k8s.io\"\n      - group: \"autoscaling\"\n      - group: \"batch\"\n      - group: \"certificates.k8s.io\"\n      - group: \"extensions\"\n      - group: \"metrics.k8s.io\"\n      - group: \"networking.k8s.io\"\n      - group: \"node.k8s.io\"\n      - group: \"policy\"\n      - group: \"rbac.authorization.k8s.io\"\n      - group: \"scheduling.k8s.io\"\n      - group: \"settings.k8s.io\"\n      - group: \"storage.k8s.io\"\n    omitStages:\n      - \"RequestReceived\"\n  # Default level for all other requests.\n  - level: Metadata\n    omitStages:\n      - \"RequestReceived\""
+	if cluster.Audit.PolicyFile != "" {
+		content1 = readLocalFile(cluster.Audit.PolicyFile)
+	}
 	kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, struct {
 		Content     string `yaml:"content,omitempty"`
 		Path        string `yaml:"path"`
@@ -202,19 +224,53 @@ func generateKubeadmControlPlane(cluster pkdCluster) {
 				Name string "yaml:\"name\""
 			}{
 				Key:  "value",
-				Name: "cluster-a-etcd-encryption-config",
+				Name: encryptionSecretName(cluster.MetaData.Name),
 			},
 		},
 		Owner: "root:root",
 	})
+	if cluster.Audit.WebhookConfigFile != "" {
+		webhookConfig := KubeadmFile{Path: auditPolicyDir + "/webhook-config.yaml", Permissions: "0600"}
+		webhookConfig.ContentFrom.Secret.Name = auditWebhookSecretName(cluster.MetaData.Name)
+		webhookConfig.ContentFrom.Secret.Key = "webhook-config.yaml"
+		kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, webhookConfig)
+	}
+	if cluster.OIDC.CAFile != "" {
+		kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, KubeadmFile{
+			Content:     readLocalFile(cluster.OIDC.CAFile),
+			Path:        oidcCADir + "/ca.crt",
+			Permissions: "0644",
+		})
+	}
+	kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, proxyFiles(cluster)...)
+	kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, registryFiles(cluster)...)
+	kcp.Spec.KubeadmConfigSpec.Files = append(kcp.Spec.KubeadmConfigSpec.Files, poolFiles(cluster.Controlplane)...)
+	kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands = append(kcp.Spec.KubeadmConfigSpec.PreKubeadmCommands, cluster.Controlplane.PreKubeadmCommands...)
+	kcp.Spec.KubeadmConfigSpec.PostKubeadmCommands = append(kcp.Spec.KubeadmConfigSpec.PostKubeadmCommands, cluster.Controlplane.PostKubeadmCommands...)
 
 	data, err := yaml.Marshal(&kcp)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = os.WriteFile("resources/"+cluster.MetaData.Name+"-control-plane-KubeadmControlPlane.yaml", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return data
+}
+
+// Clients reach the api server on the endpoint host and, with kube-vip, on its address as well,
+// so both are always in its certificate along with any extra names from cluster.yaml
+func apiServerCertSANs(cluster pkdCluster) []string {
 
+	sans := []string{}
+	seen := map[string]bool{}
+	candidates := []string{}
+	if !cluster.ControlPlaneEndpoint.External {
+		candidates = append(candidates, cluster.MetaData.KubeVipLoadbalancer)
+	}
+	candidates = append(candidates, cluster.ControlPlaneEndpoint.Host)
+	for _, san := range append(candidates, cluster.ControlPlaneEndpoint.CertSANs...) {
+		if san != "" && !seen[san] {
+			sans = append(sans, san)
+			seen[san] = true
+		}
+	}
+	return sans
 }
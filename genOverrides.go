@@ -1,126 +1,80 @@
 package main
 
 import (
-	"fmt"
 	"log"
-	"os"
-	"os/exec"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
-func genOverride2_6_0(name string, nodes NodePool, registryInfo Registry, airgap bool) {
-
-	override := kibOverride{}
-
-	// Full Path with http(s)://
-	registryURL := registryInfo.Host
-
-	//Strip Protocol or we get an error, do this more elegantly later on
-	registryADDR := strings.ReplaceAll(registryURL, "https://", "")
-	registryADDR = strings.ReplaceAll(registryADDR, "http://", "")
-
-	//Example: https://harbor-registry.com/registry
-	//If no port specified, insert /v2/ after last period and before first /
-	//
-	//			https://harbor-registry.com/v2/registry
-	//
-	//If port specifed, do nothing
-	//
-	// Special Case: Docker Creds for docker.io
-	//
-	// registry-1.docker.io
-	//
-	//
-
-	//if this address doesn't a port
-	if !strings.Contains(registryADDR, ":") {
-		//don't insert a /v2/ for docker's official registry
-		if !(registryADDR == "registry-1.docker.io") {
-			// https://harbor-registry.
-			periodIndex := strings.LastIndex(registryURL, ".")
-
-			// https://harbor-registry.
-			firstHalf := registryURL[:periodIndex]
-			// com/registry
-			secondHalf := registryURL[periodIndex:]
-
-			secondHalf = strings.Replace(secondHalf, "/", "/v2/", 1)
+// ${CLUSTER_NAME}-${NODESET}-override is referenced by the PreprovisionedMachineTemplate overrideRef
+func overrideName(clusterName string, nodesetName string) string {
+	return clusterName + "-" + nodesetName + "-override"
+}
 
-			registryURL = firstHalf + secondHalf
+// returns the KIB overrides.yaml for a node pool, the caller wraps it in the override secret
+func genOverride2_6_0(cluster pkdCluster, nodes NodePool) []byte {
 
-			//for the auth section we need to remove the sub path
+	override := kibOverride{}
 
-			registryADDR = registryADDR[:strings.LastIndex(registryADDR, "/")]
+	// every registry's credentials, and its mirrors, go to pools flagged to use the registry
+	if nodes.Flags["registry"] {
+		for _, registry := range clusterRegistries(cluster) {
+			endpoint := mustParseRegistry(registry.Host)
+			for _, mirrored := range registry.Mirrors {
+				if override.DefaultImageRegistryMirrors == nil {
+					override.DefaultImageRegistryMirrors = map[string]string{}
+				}
+				override.DefaultImageRegistryMirrors[mirrored] = endpoint.MirrorURL()
+			}
+			auth := kibRegistry{
+				Host:     endpoint.Host,
+				Username: registry.Username,
+				Password: registry.Password,
+			}
+			//the first pull KIB makes must already trust the registry, the override secret keeps the client key private
+			if registryTLSEnabled(registry) {
+				auth.TLS = &struct {
+					CACert             string `yaml:"caCert,omitempty"`
+					ClientCert         string `yaml:"clientCert,omitempty"`
+					ClientKey          string `yaml:"clientKey,omitempty"`
+					InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+				}{InsecureSkipVerify: registry.InsecureSkipVerify}
+				if registry.CAFile != "" {
+					auth.TLS.CACert = readLocalFile(registry.CAFile)
+				}
+				if registry.CertFile != "" {
+					auth.TLS.ClientCert = readLocalFile(registry.CertFile)
+					auth.TLS.ClientKey = readLocalFile(registry.KeyFile)
+				}
+			}
+			override.ImageRegistriesWithAuth = append(override.ImageRegistriesWithAuth, auth)
 		}
 	}
 
-	// If this is an Air Gap Registry override
-	if airgap && nodes.Flags["registry"] {
-
-		override.DefaultImageRegistryMirrors.DockerIo = registryURL
-		override.DefaultImageRegistryMirrors.Wildcard = registryURL
-		override.ImageRegistriesWithAuth = append(override.ImageRegistriesWithAuth,
-			struct {
-				Host          string "yaml:\"host,omitempty\""
-				Username      string "yaml:\"username,omitempty\""
-				Password      string "yaml:\"password,omitempty\""
-				Auth          string "yaml:\"auth,omitempty\""
-				IdentityToken string "yaml:\"identityToken,omitempty\""
-			}{
-				Host:          registryADDR,
-				Username:      registryInfo.Username,
-				Password:      registryInfo.Password,
-				Auth:          "",
-				IdentityToken: "",
-			})
-	}
-
-	// If this is a regular Registry Override
-	if !airgap && nodes.Flags["registry"] {
-
-		override.ImageRegistriesWithAuth = append(override.ImageRegistriesWithAuth,
-			struct {
-				Host          string "yaml:\"host,omitempty\""
-				Username      string "yaml:\"username,omitempty\""
-				Password      string "yaml:\"password,omitempty\""
-				Auth          string "yaml:\"auth,omitempty\""
-				IdentityToken string "yaml:\"identityToken,omitempty\""
-			}{
-				Host:          registryADDR,
-				Username:      registryInfo.Username,
-				Password:      registryInfo.Password,
-				Auth:          "",
-				IdentityToken: "",
-			})
-	}
-
 	// GPUs are not supported in Air Gap in 2.2.0
-	if nodes.Flags["gpu"] && !airgap {
+	if nodes.Flags["gpu"] && !cluster.AirGap.Enabled {
 		override.Gpu.Types = append(override.Gpu.Types, "nvidia")
 		override.BuildNameExtra = "-nvidia"
 	}
 
-	data, err := yaml.Marshal(&override)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = os.WriteFile("overrides/"+name+".yaml", data, 0644)
-	if err != nil {
-		log.Fatal(err)
+	//air gapped hosts install kubernetes from the bundles seedHosts uploaded, which are named after the pool's version
+	if cluster.AirGap.Enabled {
+		override.OsPackagesLocalBundleFile = kibArtifactsDir + "/" + osPackagesBundle(artifactK8sVersion(poolK8sVersion(cluster, nodes)), cluster.AirGap.OsVersion)
+		override.PipPackagesLocalBundleFile = kibArtifactsDir + "/pip-packages.tar.gz"
+		override.ImagesLocalBundleDir = kibArtifactsDir + "/images"
 	}
-	cmd := exec.Command("kubectl", "create", "secret", "generic", name, "--from-file=overrides.yaml=overrides/"+name+".yaml")
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
+
+	//KIB downloads packages and images on the hosts through the same proxy the cluster uses
+	if proxyEnabled(cluster.Proxy) {
+		override.HTTPProxy = cluster.Proxy.HTTPProxy
+		override.HTTPSProxy = cluster.Proxy.HTTPSProxy
+		override.NoProxy = strings.Join(noProxy(cluster), ",")
 	}
-	cmd = exec.Command("kubectl", "label", "secret", name, "clusterctl.cluster.x-k8s.io/move=")
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
+
+	data, err := yaml.Marshal(&override)
 	if err != nil {
 		log.Fatal(err)
 	}
-
+	return data
 }
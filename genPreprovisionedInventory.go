@@ -2,22 +2,19 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"gopkg.in/yaml.v3"
 )
 
-func genCPPI(mdata MetaData, cplane NodePool) {
+func genCPPI(mdata MetaData, cplane NodePool) []byte {
 
-	//initialize the array
-	hosts := make([]map[string]string, len(cplane.Hosts))
-	index := 0
-	//create the array of hosts
-	for _, ip := range cplane.Hosts {
-		hosts[index] = map[string]string{"address": ip}
-		index++
+	//create the array of hosts, CAPPP initializes the cluster on the first one
+	hosts := []map[string]string{}
+	for _, name := range orderedHosts(cplane) {
+		hosts = append(hosts, map[string]string{"address": cplane.Hosts[name].Address})
 	}
 
+	ssh := poolSSH(mdata, cplane)
 	ppi := map[string]interface{}{
 		"apiVersion": "infrastructure.cluster.konvoy.d2iq.io/v1alpha1",
 		"kind":       "PreprovisionedInventory",
@@ -32,10 +29,10 @@ func genCPPI(mdata MetaData, cplane NodePool) {
 		"spec": map[string]interface{}{
 			"hosts": hosts,
 			"sshConfig": map[string]interface{}{
-				"port": 22,
-				"user": mdata.SshUser,
+				"port": ssh.Port,
+				"user": ssh.User,
 				"privateKeyRef": map[string]string{
-					"name":      mdata.Name + "-ssh-key",
+					"name":      sshSecretName(mdata, "control-plane", cplane),
 					"namespace": "default",
 				},
 			},
@@ -48,25 +45,18 @@ func genCPPI(mdata MetaData, cplane NodePool) {
 		log.Fatal(err)
 	}
 
-	err2 := os.WriteFile("resources/"+mdata.Name+"-control-plane-PreprovisionedInventory.yaml", data, 0644)
-
-	if err2 != nil {
-
-		log.Fatal(err2)
-	}
+	return data
 }
 
-func genPPI(mdata MetaData, npool NodePool, nodesetName string) {
+func genPPI(mdata MetaData, npool NodePool, nodesetName string) []byte {
 
-	//initialize the array
-	hosts := make([]map[string]string, len(npool.Hosts))
-	index := 0
 	//create the array of hosts
-	for _, ip := range npool.Hosts {
-		hosts[index] = map[string]string{"address": ip}
-		index++
+	hosts := []map[string]string{}
+	for _, name := range orderedHosts(npool) {
+		hosts = append(hosts, map[string]string{"address": npool.Hosts[name].Address})
 	}
 
+	ssh := poolSSH(mdata, npool)
 	ppi := map[string]interface{}{
 		"apiVersion": "infrastructure.cluster.konvoy.d2iq.io/v1alpha1",
 		"kind":       "PreprovisionedInventory",
@@ -81,10 +71,10 @@ func genPPI(mdata MetaData, npool NodePool, nodesetName string) {
 		"spec": map[string]interface{}{
 			"hosts": hosts,
 			"sshConfig": map[string]interface{}{
-				"port": 22,
-				"user": mdata.SshUser,
+				"port": ssh.Port,
+				"user": ssh.User,
 				"privateKeyRef": map[string]string{
-					"name":      mdata.Name + "-ssh-key",
+					"name":      sshSecretName(mdata, nodesetName, npool),
 					"namespace": "default",
 				},
 			},
@@ -97,10 +87,5 @@ func genPPI(mdata MetaData, npool NodePool, nodesetName string) {
 		log.Fatal(err)
 	}
 
-	err2 := os.WriteFile("resources/"+mdata.Name+"-"+nodesetName+"-PreprovisionedInventory.yaml", data, 0644)
-
-	if err2 != nil {
-
-		log.Fatal(err2)
-	}
+	return data
 }
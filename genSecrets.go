@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secrets are written as manifests under resources/ instead of being created directly with kubectl
+// so that pkd render can produce them without a bootstrap cluster
+func generateSecret(clusterName string, name string, data map[string][]byte) []byte {
+
+	secret := k8sSecret{}
+	secret.APIVersion = "v1"
+	secret.Kind = "Secret"
+	secret.Metadata.Name = name
+	secret.Metadata.Namespace = "default"
+	secret.Metadata.Labels = map[string]string{
+		"cluster.x-k8s.io/cluster-name":    clusterName,
+		"clusterctl.cluster.x-k8s.io/move": "",
+	}
+	secret.Type = "Opaque"
+	secret.Data = map[string]string{}
+	for key, value := range data {
+		secret.Data[key] = base64.StdEncoding.EncodeToString(value)
+	}
+
+	file, err := yaml.Marshal(&secret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return file
+}
+
+// ${CLUSTER_NAME}-ssh-key, or a pool's own key secret, is referenced by the PreprovisionedInventory sshConfig
+func generateSSHSecret(clusterName string, name string, keyFile string) []byte {
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return generateSecret(clusterName, name, map[string][]byte{"ssh-privatekey": key})
+}
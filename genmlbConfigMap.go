@@ -1,15 +1,13 @@
 package main
 
 import (
-	"fmt"
 	"log"
-	"os"
-	"os/exec"
+	"path/filepath"
 
 	"gopkg.in/yaml.v3"
 )
 
-func generateMlbConfigMap(cluster pkdCluster) {
+func generateMlbConfigMap(cluster pkdCluster) []byte {
 
 	mlb := mlbConfigMap{}
 	mlb.APIVersion = "v1"
@@ -27,17 +25,11 @@ func generateMlbConfigMap(cluster pkdCluster) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = os.WriteFile("resources/"+cluster.MetaData.Name+"-Metal-LB-ConfigMap.yaml", data, 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return data
+}
 
-	cmd := exec.Command("kubectl", "create", "-f", "resources/"+cluster.MetaData.Name+"-Metal-LB-ConfigMap.yaml")
-	//run the command
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+// metallb only exists on the workload cluster, this is applied once the cluster has pivoted
+func applyMlbConfigMap(clusterName string) {
 
+	applyFile(mustKubeClient(clusterName+".conf"), filepath.Join(defaultOutput.ResourcesDir, clusterName+"-Metal-LB-ConfigMap.yaml"))
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// a host is either just its address, ie worker1: 10.0.0.14, or a mapping with its own ssh settings and labels
+func (h *Host) UnmarshalYAML(value *yaml.Node) error {
+
+	if value.Kind == yaml.ScalarNode {
+		*h = Host{Address: value.Value}
+		return nil
+	}
+	//decoding into a type without UnmarshalYAML avoids recursing back in here
+	type plain Host
+	return value.Decode((*plain)(h))
+}
+
+// hosts with nothing but an address keep the short form in cluster.yaml
+func (h Host) MarshalYAML() (interface{}, error) {
+
+	if h.Port == 0 && h.User == "" && h.SshPrivateKey == "" && len(h.Labels) == 0 {
+		return h.Address, nil
+	}
+	type plain Host
+	return plain(h), nil
+}
+
+// ssh settings used to reach a host, anything it doesn't set comes from metadata
+type sshConfig struct {
+	User       string
+	Port       int
+	PrivateKey string
+}
+
+func hostSSH(mdata MetaData, host Host) sshConfig {
+
+	ssh := sshConfig{User: mdata.SshUser, Port: 22, PrivateKey: mdata.SshPrivateKey}
+	if host.User != "" {
+		ssh.User = host.User
+	}
+	if host.Port != 0 {
+		ssh.Port = host.Port
+	}
+	if host.SshPrivateKey != "" {
+		ssh.PrivateKey = host.SshPrivateKey
+	}
+	return ssh
+}
+
+// A PreprovisionedInventory has a single sshConfig, so every host of a nodeset shares one.
+// poolNodesets splits node pools on it and validateCluster rejects a control plane whose hosts disagree
+func poolSSH(mdata MetaData, pool NodePool) sshConfig {
+
+	if names := orderedHosts(pool); len(names) > 0 {
+		return hostSSH(mdata, pool.Hosts[names[0]])
+	}
+	return hostSSH(mdata, Host{})
+}
+
+// pools using the metadata key share ${CLUSTER_NAME}-ssh-key, any other key gets a secret of its own
+func sshSecretName(mdata MetaData, nodesetName string, pool NodePool) string {
+
+	if poolSSH(mdata, pool).PrivateKey == mdata.SshPrivateKey {
+		return mdata.Name + "-ssh-key"
+	}
+	return mdata.Name + "-" + nodesetName + "-ssh-key"
+}
+
+// Hosts with their own ssh settings or labels can't share a PreprovisionedInventory and
+// KubeadmConfigTemplate with the rest of their pool, so every group of hosts that agree is
+// deployed as a nodeset of its own. The group of the first host keeps the pool name, the
+// others become <pool>-1, <pool>-2 and so on. Host labels are added to the pool labels
+func poolNodesets(mdata MetaData, poolName string, pool NodePool) map[string]NodePool {
+
+	nodesets := map[string]NodePool{}
+	groups := map[string]string{}
+	for _, name := range orderedHosts(pool) {
+		host := pool.Hosts[name]
+		group := fmt.Sprintf("%v %s", hostSSH(mdata, host), nodeLabels(host.Labels))
+		nodesetName, ok := groups[group]
+		if !ok {
+			nodesetName = poolName
+			if len(groups) > 0 {
+				nodesetName = fmt.Sprintf("%s-%d", poolName, len(groups))
+			}
+			groups[group] = nodesetName
+			nodeset := pool
+			nodeset.Hosts = map[string]Host{}
+			nodeset.Labels = map[string]string{}
+			for key, value := range pool.Labels {
+				nodeset.Labels[key] = value
+			}
+			for key, value := range host.Labels {
+				nodeset.Labels[key] = value
+			}
+			nodesets[nodesetName] = nodeset
+		}
+		nodesets[nodesetName].Hosts[name] = host
+	}
+	return nodesets
+}
+
+// the nodesets of every node pool, each one gets its own inventory, templates and MachineDeployment
+func clusterNodesets(cluster pkdCluster) map[string]NodePool {
+
+	nodesets := map[string]NodePool{}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		for nodesetName, nodeset := range poolNodesets(cluster.MetaData, poolName, cluster.NodePools[poolName]) {
+			nodesets[nodesetName] = nodeset
+		}
+	}
+	return nodesets
+}
+
+// host names sorted so generated files are stable between runs, the init host always comes first
+func orderedHosts(pool NodePool) []string {
+
+	names := []string{}
+	if _, ok := pool.Hosts[pool.InitHost]; ok {
+		names = append(names, pool.InitHost)
+	}
+	for _, name := range sortedHostNames(pool.Hosts) {
+		if name != pool.InitHost {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// the control plane followed by every node pool in name order
+func allPools(cluster pkdCluster) []NodePool {
+
+	pools := []NodePool{cluster.Controlplane}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		pools = append(pools, cluster.NodePools[poolName])
+	}
+	return pools
+}
+
+// every private key the hosts of the cluster are reached with, metadata.sshprivatekey first
+func sshPrivateKeys(cluster pkdCluster) []string {
+
+	keys := []string{cluster.MetaData.SshPrivateKey}
+	seen := map[string]bool{cluster.MetaData.SshPrivateKey: true}
+	for _, pool := range allPools(cluster) {
+		for _, name := range orderedHosts(pool) {
+			key := hostSSH(cluster.MetaData, pool.Hosts[name]).PrivateKey
+			if !seen[key] {
+				keys = append(keys, key)
+				seen[key] = true
+			}
+		}
+	}
+	return keys
+}
+
+// kubelet --node-labels takes a sorted, comma separated list of key=value
+func nodeLabels(labels map[string]string) string {
+
+	pairs := []string{}
+	for _, key := range sortedKeys(labels) {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Setting any taints in nodeRegistration replaces the ones kubeadm adds by default,
+// so the control plane keeps its NoSchedule taint unless cluster.yaml sets it explicitly
+func poolTaints(pool NodePool, controlPlane bool) []Taint {
+
+	if len(pool.Taints) == 0 {
+		return nil
+	}
+	taints := append([]Taint{}, pool.Taints...)
+	if controlPlane {
+		for _, taint := range taints {
+			if taint.Key == "node-role.kubernetes.io/control-plane" {
+				return taints
+			}
+		}
+		taints = append(taints, Taint{Key: "node-role.kubernetes.io/control-plane", Effect: "NoSchedule"})
+	}
+	return taints
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// kubernetes versions each DKP release can deploy, the first is the release default
+// workers may stay one minor behind the control plane during a staged upgrade
+var dkpK8sVersions = map[string][]string{
+	"v2.4": {"v1.24.6"},
+	"v2.5": {"v1.25.4", "v1.24.6"},
+	"v2.6": {"v1.26.6", "v1.25.4"},
+}
+
+var k8sVersionRegex = regexp.MustCompile(`^v(\d+)\.(\d+)\.(\d+)$`)
+
+// CAPI objects expect a leading v, ie v1.26.6
+func normalizeK8sVersion(version string) string {
+	version = strings.TrimSpace(version)
+	if version != "" && !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return version
+}
+
+// konvoy-image artifacts are named without the leading v, ie 1.26.6_centos_7_x86_64.tar.gz
+func artifactK8sVersion(version string) string {
+	return strings.TrimPrefix(normalizeK8sVersion(version), "v")
+}
+
+// the minor release of a DKP version, ie v2.6.0 -> v2.6
+func dkpMinor(dkpVersion string) string {
+	parts := strings.SplitN(normalizeK8sVersion(dkpVersion), ".", 3)
+	if len(parts) < 2 {
+		return dkpVersion
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// default kubernetes version for the configured DKP release
+func defaultK8sVersion(dkpVersion string) string {
+	if versions, ok := dkpK8sVersions[dkpMinor(dkpVersion)]; ok {
+		return versions[0]
+	}
+	return ""
+}
+
+// the version a node pool is deployed with, the pool override wins over metadata.k8sversion
+func poolK8sVersion(cluster pkdCluster, pool NodePool) string {
+	if pool.K8sVersion != "" {
+		return normalizeK8sVersion(pool.K8sVersion)
+	}
+	return cluster.MetaData.K8sVersion
+}
+
+// returns the major and minor of a version or an error if it isn't of the form v1.26.6
+func parseK8sVersion(version string) (int, int, error) {
+	match := k8sVersionRegex.FindStringSubmatch(normalizeK8sVersion(version))
+	if match == nil {
+		return 0, 0, fmt.Errorf("%q is not a kubernetes version of the form v1.26.6", version)
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	return major, minor, nil
+}
+
+// check a version is one the configured DKP release can deploy, patch releases included
+// since KIB only ships os packages for the exact versions in the release
+func supportedK8sVersion(dkpVersion string, version string) error {
+	if _, _, err := parseK8sVersion(version); err != nil {
+		return err
+	}
+	versions, ok := dkpK8sVersions[dkpMinor(dkpVersion)]
+	if !ok {
+		return fmt.Errorf("pkd does not know which kubernetes versions DKP %s supports", dkpVersion)
+	}
+	for _, v := range versions {
+		if v == normalizeK8sVersion(version) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not supported by DKP %s, use one of %s", normalizeK8sVersion(version), dkpVersion, strings.Join(versions, ", "))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// dkp create bootstrap writes the bootstrap cluster's kubeconfig here instead of ~/.kube/config,
+// so no step depends on whichever context happens to be current
+const bootstrapKubeconfig = stateDir + "/bootstrap.conf"
+
+// how often pkd checks on the conditions it is waiting for
+const pollInterval = 10 * time.Second
+
+var clusterResource = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "clusters"}
+var machineResource = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "machines"}
+
+// What pkd does against a cluster. Like commandRunner, this lets the orchestration be run
+// against a fake instead of real bootstrap and workload clusters
+type kubeAPI interface {
+	// server side apply a single object, reporting whether it was created, configured or unchanged
+	apply(obj *unstructured.Unstructured) (string, error)
+	// whether the CAPI cluster object is in the default namespace, only a not found answer means it isn't
+	hasCluster(clusterName string) (bool, error)
+	waitForClusterCondition(clusterName string, conditionType string, timeout time.Duration) error
+	waitForMachinesReady(clusterName string, timeout time.Duration) error
+	waitForMachinesDeleted(clusterName string, timeout time.Duration) error
+}
+
+// connects to the cluster a kubeconfig points at
+type kubeConnector interface {
+	connect(kubeconfig string) (kubeAPI, error)
+}
+
+var kube kubeConnector = clientConnector{}
+
+type clientConnector struct{}
+
+func (clientConnector) connect(kubeconfig string) (kubeAPI, error) {
+	client, err := newKubeClient(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// dynamic client for whatever cluster a kubeconfig points at, so pkd doesn't need kubectl installed
+type kubeClient struct {
+	dynamic dynamic.Interface
+	mapper  *restmapper.DeferredDiscoveryRESTMapper
+}
+
+// An empty kubeconfig uses the current context, honouring $KUBECONFIG like kubectl does
+func newKubeClient(kubeconfig string) (*kubeClient, error) {
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		dynamic: dynamicClient,
+		mapper:  restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+	}, nil
+}
+
+func mustKubeClient(kubeconfig string) kubeAPI {
+	client, err := kube.connect(kubeconfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return client
+}
+
+// resource interface for an object, namespaced objects without a namespace go to default
+func (c *kubeClient) resourceFor(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+
+	gvk := obj.GroupVersionKind()
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	//CRDs installed since discovery ran, ie by dkp create bootstrap, need a fresh look
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return c.dynamic.Resource(mapping.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace("default")
+	}
+	return c.dynamic.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+// check if the CAPI cluster object exists in the cluster a kubeconfig points at. A missing kubeconfig
+// means there is no cluster to look in, but a cluster that can't be reached is an error and not a
+// cluster without the object, callers deleting things based on the answer need to know the difference
+func clusterExists(clusterName string, kubeconfig string) (bool, error) {
+
+	if _, err := os.Stat(kubeconfig); os.IsNotExist(err) {
+		return false, nil
+	}
+	client, err := kube.connect(kubeconfig)
+	if err != nil {
+		return false, err
+	}
+	return client.hasCluster(clusterName)
+}
+
+func (c *kubeClient) hasCluster(clusterName string) (bool, error) {
+	_, err := c.dynamic.Resource(clusterResource).Namespace("default").Get(context.TODO(), clusterName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// find a condition in status.conditions, ok is false if it hasn't been reported yet
+func objectCondition(obj *unstructured.Unstructured, conditionType string) (map[string]interface{}, bool) {
+
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == conditionType {
+			return condition, true
+		}
+	}
+	return nil, false
+}
+
+func conditionTrue(obj *unstructured.Unstructured, conditionType string) bool {
+	condition, ok := objectCondition(obj, conditionType)
+	return ok && condition["status"] == "True"
+}
+
+// Wait for a condition on the CAPI cluster object, printing it every time it changes
+func (c *kubeClient) waitForClusterCondition(clusterName string, conditionType string, timeout time.Duration) error {
+
+	last := ""
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		cluster, err := c.dynamic.Resource(clusterResource).Namespace("default").Get(context.TODO(), clusterName, metav1.GetOptions{})
+		if err != nil {
+			//the api server is briefly unavailable while control planes come up and during a pivot
+			fmt.Fprintln(console, "Could not get cluster "+clusterName+": "+err.Error())
+			return false, nil
+		}
+		status := "Unknown"
+		if condition, ok := objectCondition(cluster, conditionType); ok {
+			status = fmt.Sprintf("%v", condition["status"])
+			if reason, ok := condition["reason"]; ok && reason != "" {
+				status += " (" + fmt.Sprintf("%v", reason) + ")"
+			}
+		}
+		if status != last {
+			fmt.Fprintln(console, "Cluster "+clusterName+" "+conditionType+": "+status)
+			last = status
+		}
+		return conditionTrue(cluster, conditionType), nil
+	})
+}
+
+// Wait for every machine of a cluster to be Ready, printing progress as machines come up
+func (c *kubeClient) waitForMachinesReady(clusterName string, timeout time.Duration) error {
+
+	last := ""
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		machines, err := c.listMachines(clusterName)
+		if err != nil {
+			fmt.Fprintln(console, "Could not list machines: "+err.Error())
+			return false, nil
+		}
+		ready := 0
+		for i := range machines.Items {
+			if conditionTrue(&machines.Items[i], "Ready") {
+				ready++
+			}
+		}
+		progress := fmt.Sprintf("%d/%d machines ready", ready, len(machines.Items))
+		if progress != last {
+			fmt.Fprintln(console, progress)
+			last = progress
+		}
+		return len(machines.Items) > 0 && ready == len(machines.Items), nil
+	})
+}
+
+// machines are only gone once CAPPP has finished cleaning up the preprovisioned hosts
+func (c *kubeClient) waitForMachinesDeleted(clusterName string, timeout time.Duration) error {
+
+	last := -1
+	return wait.PollImmediate(pollInterval, timeout, func() (bool, error) {
+		machines, err := c.listMachines(clusterName)
+		if err != nil {
+			fmt.Fprintln(console, "Could not list machines: "+err.Error())
+			return false, nil
+		}
+		if len(machines.Items) != last {
+			fmt.Fprintf(console, "%d machines remaining\n", len(machines.Items))
+			last = len(machines.Items)
+		}
+		return len(machines.Items) == 0, nil
+	})
+}
+
+func (c *kubeClient) listMachines(clusterName string) (*unstructured.UnstructuredList, error) {
+	return c.dynamic.Resource(machineResource).Namespace("default").List(context.TODO(), metav1.ListOptions{
+		LabelSelector: "cluster.x-k8s.io/cluster-name=" + clusterName,
+	})
+}
+
+// cluster.yaml timeouts are whole minutes, validateCluster has already checked them
+func minutes(timeout string) time.Duration {
+	m, err := strconv.Atoi(timeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return time.Duration(m) * time.Minute
+}
+
+func defaultKubeconfig() string {
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+// ~/.kube/config may not exist yet on a fresh jump host
+func loadDefaultKubeconfig() *clientcmdapi.Config {
+
+	config, err := clientcmd.LoadFromFile(defaultKubeconfig())
+	if os.IsNotExist(err) {
+		return clientcmdapi.NewConfig()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHasCluster(t *testing.T) {
+
+	demo := &unstructured.Unstructured{}
+	demo.SetAPIVersion("cluster.x-k8s.io/v1beta1")
+	demo.SetKind("Cluster")
+	demo.SetNamespace("default")
+	demo.SetName("demo")
+
+	tests := []struct {
+		name    string
+		getErr  error
+		want    bool
+		wantErr bool
+	}{
+		{name: "demo", want: true},
+		{name: "other", want: false},
+		{name: "demo", getErr: apierrors.NewForbidden(clusterResource.GroupResource(), "demo", errors.New("no access")), wantErr: true},
+		{name: "demo", getErr: errors.New("connection refused"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), demo.DeepCopy())
+		if test.getErr != nil {
+			getErr := test.getErr
+			client.PrependReactor("get", "clusters", func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, getErr
+			})
+		}
+		found, err := (&kubeClient{dynamic: client}).hasCluster(test.name)
+		if test.wantErr {
+			//down deletes files when the cluster is not found, so an error must never read as not found
+			if err == nil {
+				t.Errorf("hasCluster(%q) with %v returned %v and no error", test.name, test.getErr, found)
+			}
+			continue
+		}
+		if err != nil || found != test.want {
+			t.Errorf("hasCluster(%q) = %v, %v, want %v", test.name, found, err, test.want)
+		}
+	}
+}
+
+// without a kubeconfig there is no cluster to look in, so nothing is connected to
+func TestClusterExistsWithoutKubeconfig(t *testing.T) {
+
+	_, fakeKube := withFakes(t)
+	exists, err := clusterExists("demo", "demo.conf")
+	if exists || err != nil {
+		t.Errorf("clusterExists without demo.conf = %v, %v, want false", exists, err)
+	}
+	if len(fakeKube.Calls) != 0 {
+		t.Errorf("clusterExists without demo.conf made kube calls %v", fakeKube.Calls)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Where generated manifests are written. The generators only build bytes,
+// the caller decides where they land
+type renderOutput struct {
+	ResourcesDir string
+	OverridesDir string
+	//when set, manifests are kept here by path instead of being written to disk
+	Files map[string][]byte
+}
+
+// pkd up applies everything from resources/ in the working directory
+var defaultOutput = renderOutput{ResourcesDir: "resources", OverridesDir: "overrides"}
+
+// output rooted under dir, ie pkd render --output <dir>
+func outputUnder(dir string) renderOutput {
+	return renderOutput{
+		ResourcesDir: filepath.Join(dir, "resources"),
+		OverridesDir: filepath.Join(dir, "overrides"),
+	}
+}
+
+// output that never touches the disk, the tests compare what it holds against their goldens
+func memoryOutput() renderOutput {
+	return renderOutput{ResourcesDir: "resources", OverridesDir: "overrides", Files: map[string][]byte{}}
+}
+
+func (o renderOutput) mkdirs() {
+	if o.Files != nil {
+		return
+	}
+	for _, dir := range []string{o.ResourcesDir, o.OverridesDir} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// resources/<name>.yaml
+func (o renderOutput) resource(name string, data []byte) {
+	o.write(filepath.Join(o.ResourcesDir, name+".yaml"), data, 0644)
+}
+
+// secrets hold keys and credentials, keep them readable only by us
+func (o renderOutput) secret(name string, data []byte) {
+	o.write(filepath.Join(o.ResourcesDir, name+"-Secret.yaml"), data, 0600)
+}
+
+// overrides/<name>.yaml, a readable copy of each KIB override secret. It holds the same
+// registry and proxy credentials as the secret, so it is kept just as private
+func (o renderOutput) override(name string, data []byte) {
+	o.write(filepath.Join(o.OverridesDir, name+".yaml"), data, 0600)
+}
+
+func (o renderOutput) write(path string, data []byte, perm os.FileMode) {
+	if o.Files != nil {
+		o.Files[path] = data
+		return
+	}
+	writeManifest(path, data, perm)
+}
+
+// WriteFile only applies perm to new files, a rerun must also tighten one written before
+func writeManifest(path string, data []byte, perm os.FileMode) {
+	err := os.WriteFile(path, data, perm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Chmod(path, perm)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
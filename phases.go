@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const stateDir = ".pkd"
+const stateFile = stateDir + "/state.yaml"
+
+// phases of pkd up in the order they run, see docs/pkdUP.md
+var upPhases = []string{
+	"seed",
+	"bootstrap",
+	"inventory",
+	"dryrun",
+	"objects",
+	"deploy",
+	"pivot",
+	"cleanup",
+	"kubeconfig",
+}
+
+func phaseIndex(phase string) int {
+	for i, name := range upPhases {
+		if name == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// an empty state is returned when pkd up has never been run in this directory
+func loadUpState() upState {
+
+	state := upState{}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = yaml.Unmarshal(data, &state)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return state
+}
+
+func saveUpState(state upState) {
+
+	err := os.MkdirAll(stateDir, os.ModePerm)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := yaml.Marshal(&state)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(stateFile, data, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// record a phase as completed, replacing any earlier run of it
+func completePhase(state *upState, phase string) {
+
+	phases := []phaseState{}
+	for _, done := range state.Phases {
+		if done.Name != phase {
+			phases = append(phases, done)
+		}
+	}
+	state.Phases = append(phases, phaseState{Name: phase, Completed: time.Now().Format(time.RFC3339)})
+	saveUpState(*state)
+}
+
+func phaseCompleted(state upState, phase string) bool {
+	for _, done := range state.Phases {
+		if done.Name == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Work out which phases to run from the up flags and the saved state.
+// A run that starts from the first phase begins with a fresh state
+func planPhases(clusterName string, resume bool, fromPhase string, untilPhase string) (upState, int, int, bool) {
+
+	state := loadUpState()
+	first, last := 0, len(upPhases)-1
+
+	if untilPhase != "" {
+		last = phaseIndex(untilPhase)
+		if last < 0 {
+			fmt.Fprintln(console, "Unknown phase "+untilPhase+", valid phases are: "+strings.Join(upPhases, ", "))
+			return state, 0, 0, false
+		}
+	}
+
+	if resume || fromPhase != "" {
+		//never resume a deploy of a different cluster
+		if state.Cluster != "" && state.Cluster != clusterName {
+			fmt.Fprintln(console, stateFile+" belongs to cluster "+state.Cluster+", not "+clusterName+"! Exiting!")
+			return state, 0, 0, false
+		}
+		state.Cluster = clusterName
+	}
+
+	switch {
+	case fromPhase != "":
+		first = phaseIndex(fromPhase)
+		if first < 0 {
+			fmt.Fprintln(console, "Unknown phase "+fromPhase+", valid phases are: "+strings.Join(upPhases, ", "))
+			return state, 0, 0, false
+		}
+		for _, phase := range upPhases[:first] {
+			if !phaseCompleted(state, phase) {
+				fmt.Fprintln(console, "Warning: phase "+phase+" has not completed, starting from "+fromPhase+" anyway")
+				break
+			}
+		}
+	case resume:
+		first = len(upPhases)
+		for i, phase := range upPhases {
+			if !phaseCompleted(state, phase) {
+				first = i
+				break
+			}
+		}
+		if first == len(upPhases) {
+			fmt.Fprintln(console, "Every phase of pkd up has already completed for cluster "+clusterName)
+			return state, 0, 0, false
+		}
+		fmt.Fprintln(console, "Resuming pkd up from phase "+upPhases[first])
+	}
+
+	if first == 0 {
+		state = upState{Cluster: clusterName}
+		saveUpState(state)
+	}
+	if first > last {
+		fmt.Fprintln(console, "Phase "+upPhases[first]+" comes after phase "+upPhases[last]+", nothing to run! Exiting!")
+		return state, 0, 0, false
+	}
+	return state, first, last, true
+}
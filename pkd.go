@@ -6,26 +6,32 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/schollz/progressbar/v3"
 	"gopkg.in/yaml.v3"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const pkdVersion = "v1.0.3-dkp2.6.0"
-const bundleDir = "dkp-air-gapped-bundle_v2.6.0_linux_amd64/dkp-v2.6.0/"
+
+// where the DKP Air Gap Bundle for a release unpacks to, ie dkp-air-gapped-bundle_v2.6.0_linux_amd64/dkp-v2.6.0/
+func bundleDir(dkpVersion string) string {
+	return "dkp-air-gapped-bundle_" + dkpVersion + "_linux_amd64/dkp-" + dkpVersion + "/"
+}
 
 func main() {
 
+	log.SetOutput(redactingWriter{os.Stderr})
 	argNum := len(os.Args)
 	// you must run pkd with at least one argument
 	if argNum >= 2 {
@@ -35,38 +41,49 @@ func main() {
 		//init
 		case arg1 == "init":
 			if argNum >= 3 && os.Args[2] == "ag" {
-				fmt.Println("Generating air gap cluster.yaml")
+				fmt.Fprintln(console, "Generating air gap cluster.yaml")
 				initAGYaml()
 			} else {
-				fmt.Println("Generating cluster.yaml")
+				fmt.Fprintln(console, "Generating cluster.yaml")
 				initYaml()
 			}
+		//validate
+		case arg1 == "validate":
+			if !checkCluster(loadCluster()) {
+				os.Exit(1)
+			}
+			fmt.Fprintln(console, "cluster.yaml is valid")
+		//render
+		case arg1 == "render":
+			fmt.Fprintln(console, "Rendering cluster resources")
+			render(os.Args[2:])
 		//up
 		case arg1 == "up":
-			if argNum >= 3 && os.Args[2] == "yee-haw" {
-				fmt.Println("Good Luck Cowboy!")
-				up("pause")
-			} else {
-				up("normal")
-			}
+			up(os.Args[2:])
+		//down
+		case arg1 == "down":
+			down(os.Args[2:])
+		//airgap
+		case arg1 == "airgap":
+			fmt.Fprintln(console, "Building Air Gap Bundle")
+			airgap()
 		case arg1 == "version":
 
-			fmt.Println("PKD Version: " + pkdVersion)
+			fmt.Fprintln(console, "PKD Version: "+pkdVersion)
 			//check if the dkp cli is present
-			cmd := exec.Command("./dkp", "version")
-
-			//run the command
-			output, err := cmd.CombinedOutput()
-			fmt.Println(string(output))
-			if err != nil {
-				log.Fatal(err)
-			}
+			run(newCommand("./dkp", "version"))
 		//no args or bad args
 		default:
-			fmt.Printf("Usage:\n" +
-				" pkd init [ag]				create cluster.yaml for on prem or air gap\n" +
-				" pkd airgap				download all airgap resources and create a tar.gz bundle\n" +
-				" pkd up [yee-haw]			create all yaml resources needed to deploy a cluster, optional cowboy mode\n" +
+			fmt.Fprintf(console, "Usage:\n"+
+				" pkd init [ag]				create cluster.yaml for on prem or air gap\n"+
+				" pkd airgap				download all airgap resources and create a tar.gz bundle\n"+
+				" pkd validate				check cluster.yaml for problems before deploying\n"+
+				" pkd render [--output <dir>]		write all yaml resources for cluster.yaml without deploying anything\n"+
+				" pkd up [yee-haw]			create all yaml resources needed to deploy a cluster, optional cowboy mode\n"+
+				"    [--resume]				continue from the first phase that has not completed\n"+
+				"    [--from-phase <phase>]		start from a phase: "+strings.Join(upPhases, ", ")+"\n"+
+				"    [--until-phase <phase>]		stop after a phase\n"+
+				" pkd down [--clean] [--yes]		delete the cluster, optionally removing its kubeconfig, resources and overrides\n"+
 				" pkd version				grab the PKD, DKP and Kommander cli versions\n")
 		}
 
@@ -74,109 +91,353 @@ func main() {
 }
 
 // Read in cluster.yaml and start the cluster creation process
-func up(modifier string) {
+func up(args []string) {
+
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	resume := flags.Bool("resume", false, "continue from the first phase that has not completed")
+	fromPhase := flags.String("from-phase", "", "start from this phase")
+	untilPhase := flags.String("until-phase", "", "stop after this phase")
+	//yee-haw is positional and may come before or after the flags
+	pause := false
+	flagArgs := []string{}
+	for _, arg := range args {
+		if arg == "yee-haw" {
+			pause = true
+		} else {
+			flagArgs = append(flagArgs, arg)
+		}
+	}
+	flags.Parse(flagArgs)
+	if pause {
+		fmt.Fprintln(console, "Good Luck Cowboy!")
+	}
 
 	//We need to generate the folder to store our k8s objects after creation
-	os.MkdirAll("resources", os.ModePerm)
-	fmt.Printf("Created resources directory\n")
+	os.MkdirAll(defaultOutput.ResourcesDir, os.ModePerm)
+	fmt.Fprintf(console, "Created resources directory\n")
 	//Overrides allow us to set docker hub credentials
-	os.MkdirAll("overrides", os.ModePerm)
-	fmt.Printf("Created overrides directory\n")
+	os.MkdirAll(defaultOutput.OverridesDir, os.ModePerm)
+	fmt.Fprintf(console, "Created overrides directory\n")
 	//we store DKP binaries here
 	os.MkdirAll("dkpBinaries", os.ModePerm)
-	fmt.Printf("Created dkp storage directory\n")
+	fmt.Fprintf(console, "Created dkp storage directory\n")
 
 	//This loads the user customizable values to generate a cluster from cluster.yaml
 	cluster := loadCluster()
-	fmt.Printf("Cluster YAML loaded into PKD\n")
+	fmt.Fprintf(console, "Cluster YAML loaded into PKD\n")
+
+	//catch mistakes in cluster.yaml now rather than 40 minutes into a deploy
+	if !checkCluster(cluster) {
+		return
+	}
 
 	//check if dkp version is present
 	if _, err := os.Stat("dkp"); err == nil {
 		//get the version of DKP and compare to cluster info
-		cmd := exec.Command("./dkp", "version")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.CombinedOutput(newCommand("./dkp", "version"))
 		if err != nil {
 			log.Fatal(err)
 		}
 		lines := bytes.Split(output, []byte("\n"))
 		version := string(lines[1][5:])
 		if version == cluster.MetaData.DKPversion {
-			fmt.Println("DKP Version " + version + " detected! Continuing.")
+			fmt.Fprintln(console, "DKP Version "+version+" detected! Continuing.")
 		} else {
-			fmt.Println("DKP Binary: " + version + "does not match configured version: " + cluster.MetaData.DKPversion + " ! Exiting!")
+			fmt.Fprintln(console, "DKP Binary: "+version+"does not match configured version: "+cluster.MetaData.DKPversion+" ! Exiting!")
 			return
 		}
 	} else {
-		fmt.Println("DKP Binary not present! Exiting!")
+		fmt.Fprintln(console, "DKP Binary not present! Exiting!")
 		return
 	}
 
-	//create inventory.yaml for airgap clusters
-	//we no longer use a separate kib as of DKP 2.4.0, it is part of the "everything" airgap bundle
-	if cluster.AirGap.Enabled {
+	state, first, last, ok := planPhases(cluster.MetaData.Name, *resume, *fromPhase, *untilPhase)
+	if !ok {
+		return
+	}
+
+	//each phase is recorded in .pkd/state.yaml once it succeeds so pkd up --resume can skip it
+	for _, phase := range upPhases[first : last+1] {
+		fmt.Fprintln(console, "Starting phase "+phase)
+		if !runPhase(phase, cluster, pause) {
+			return
+		}
+		completePhase(&state, phase)
+	}
+
+	if last < len(upPhases)-1 {
+		fmt.Fprintln(console, "Stopped after phase "+upPhases[last]+", continue with pkd up --resume")
+	}
+}
+
+// Run a single phase of pkd up, returning false if the deploy can't continue
+func runPhase(phase string, cluster pkdCluster, pause bool) bool {
+
+	switch phase {
+	case "seed":
+		//create inventory.yaml for airgap clusters
+		//we no longer use a separate kib as of DKP 2.4.0, it is part of the "everything" airgap bundle
+		if !cluster.AirGap.Enabled {
+			fmt.Fprintln(console, "Air gap is not enabled, nothing to seed")
+			break
+		}
 
 		//verify presence of airgap bundle
 		// dkp-air-gapped-bundle_v2.6.0_linux_amd64/dkp-v2.6.0/kib
-		fmt.Println("Please ensure DKP Airgap Bundle is unzipped to current directory")
+		fmt.Fprintln(console, "Please ensure DKP Airgap Bundle is unzipped to current directory")
 
-		if stat, err := os.Stat(bundleDir); err == nil && stat.IsDir() {
+		if stat, err := os.Stat(bundleDir(cluster.MetaData.DKPversion)); err == nil && stat.IsDir() {
 			// path is a directory
 		} else {
-			fmt.Println("Could not detect Air Gap Bundle")
-			return
+			fmt.Fprintln(console, "Could not detect Air Gap Bundle")
+			return false
 		}
 
 		generateInventory(cluster)
-		fmt.Println("Ensure AirGap Bundle is in current directory before proceeding")
-		fmt.Println("Copying ssh key defined in cluster.yaml to kib directory")
-		copy(cluster.MetaData.SshPrivateKey, bundleDir+"kib/"+cluster.MetaData.SshPrivateKey)
-		seedRegistry(cluster.Registry.Host, cluster.Registry.Username, cluster.Registry.Password, cluster.MetaData.DKPversion)
-		seedHosts(cluster.AirGap.K8sVersion, cluster.AirGap.OsVersion, cluster.AirGap.ContainerdVersion, cluster.MetaData.DKPversion)
+		fmt.Fprintln(console, "Ensure AirGap Bundle is in current directory before proceeding")
+		fmt.Fprintln(console, "Copying ssh keys defined in cluster.yaml to kib directory")
+		//konvoy-image runs in the kib directory, inventory.yaml refers to the keys by their base name
+		for _, key := range sshPrivateKeys(cluster) {
+			err := copy(key, bundleDir(cluster.MetaData.DKPversion)+"kib/"+filepath.Base(key))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		seedRegistry(airGapRegistry(cluster), cluster.MetaData.DKPversion)
+		seedHosts(artifactK8sVersion(cluster.MetaData.K8sVersion), cluster.AirGap.OsVersion, cluster.AirGap.ContainerdVersion, cluster.MetaData.DKPversion)
 		loadBootstrapImage(cluster.MetaData.DKPversion)
-	}
 
-	bootstrap("down")
-	bootstrap("up")
+	case "bootstrap":
+		bootstrap("down")
+		bootstrap("up")
 
-	//set defaults if not specified in cluster.yaml
-	//ensure that these subnets don't collide with metal-lb!
-	if cluster.MetaData.PodSubnet == "" {
-		cluster.MetaData.PodSubnet = "192.168.0.0/16"
+	case "inventory":
+		renderInventory(cluster, defaultOutput)
+
+		//apply the ssh key secret and PreProvisionedInventory objects to the bootstrap cluster
+		applyPPI(cluster.MetaData.Name)
+		fmt.Fprintf(console, "Applied all PPI\n")
+
+	case "dryrun":
+		//Generate the cluster.yaml dry run output
+		dkpDryRun(cluster)
+		fmt.Fprintf(console, "Dry Run Completed, Converting to Individual Objects\n")
+
+		//Read in the Dry Run output and generate individual object file from it
+		splitDryRun(cluster, defaultOutput)
+
+	case "objects":
+		//anything we generate ourselves replaces the matching object from the dry run
+		renderClusterObjects(cluster, defaultOutput)
+
+		fmt.Fprintf(console, "Generated all Custom Resources for NodePools\n")
+
+		//before we apply resources check for the pause flag, ie ./pkd up yee-haw
+		if pause {
+			r := bufio.NewReader(os.Stdin)
+			fmt.Fprintln(console, "Pausing, you can now manually edit objects in /resources before cluster creation")
+			input := true
+			for input {
+				fmt.Fprintf(console, "Ready to continue? Type y or yes to confirm: ")
+
+				res, err := r.ReadString('\n')
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				// Empty input (i.e. "\n")
+				if len(res) < 2 {
+					input = true
+				} else if strings.ToLower(strings.TrimSpace(res)) == "yes" || strings.ToLower(strings.TrimSpace(res)) == "y" {
+					input = false
+				}
+
+			}
+
+		}
+
+		//delete the Dry Run cluster YAML after we're done with it
+		//Moved till after the pause window in case you need to check it
+		//a resumed run may have already deleted it
+		err := os.Remove(cluster.MetaData.Name + ".yaml")
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+
+	case "deploy":
+		applyResources(cluster.MetaData.Name)
+		fmt.Fprintf(console, "Applied All Resources, Cluster Spinning Up\n")
+
+		timeout := "40"
+		if cluster.MetaData.KIBTimeout != "" {
+			timeout = cluster.MetaData.KIBTimeout
+		}
+		waitForClusterReady(cluster.MetaData.Name, timeout)
+		fmt.Fprintf(console, "Cluster Is Ready\n")
+
+	case "pivot":
+		clusterName := cluster.MetaData.Name
+		//a pivot that failed after the move already has the cluster object on the workload cluster,
+		//the bootstrap cluster no longer has it so getting the kubeconfig or moving again would fail
+		moved, err := clusterExists(clusterName, clusterName+".conf")
+		if err != nil {
+			log.Fatal("Could not check whether " + clusterName + " has already been moved to itself: " + err.Error())
+		}
+		if moved {
+			fmt.Fprintln(console, "Cluster "+clusterName+" has already been moved to itself, waiting for it to become Ready")
+		} else {
+			getKubeconfig(clusterName)
+			fmt.Fprintf(console, "Grabbed the Kubeconfig\n")
+
+			pivotCluster(clusterName)
+		}
+
+		timeout := "20"
+		if cluster.MetaData.PivotTimeout != "" {
+			timeout = cluster.MetaData.PivotTimeout
+		}
+		waitForPivot(clusterName, timeout)
+		fmt.Fprintf(console, "Pivoted the Cluster\n")
+
+	case "cleanup":
+		bootstrap("down")
+		fmt.Fprintf(console, "Cleaned up the Bootstrap Cluster\n")
+
+	case "kubeconfig":
+		mergeKubeconfig(cluster.MetaData.Name)
+		fmt.Fprintf(console, "Merged the Kubeconfig\n")
+
+		applyMlbConfigMap(cluster.MetaData.Name)
+		fmt.Fprintf(console, "Applied Metal-LB ConfigMap\n\n")
+
+		if cluster.AirGap.Enabled {
+			fmt.Fprintln(console, "The DKP cluster has now been deployed. You can proceed to deploying Kommander via:\n\n"+
+				"./dkp install kommander --init --airgapped > install.yaml\n"+
+				"./dkp install kommander --installer-config install.yaml"+
+				" --kommander-applications-repository kommander-applications-"+cluster.MetaData.DKPversion+".tar.gz"+
+				" --charts-bundle dkp-kommander-charts-bundle-"+cluster.MetaData.DKPversion+".tar.gz")
+		} else {
+			fmt.Fprintln(console, "The DKP cluster has now been deployed. You can proceed to deploying Kommander via:\n\n"+
+				"./dkp install kommander --init > kommander.yaml\n"+
+				"./dkp install kommander --installer-config kommander.yaml")
+		}
 	}
-	if cluster.MetaData.ServiceSubnet == "" {
-		cluster.MetaData.ServiceSubnet = "10.96.0.0/12"
+
+	return true
+}
+
+// Generate every resource pkd up would apply, without touching docker, dkp or any cluster
+func render(args []string) {
+
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	dir := flags.String("output", ".", "directory to write resources/ and overrides/ to")
+	flags.Parse(args)
+
+	out := outputUnder(*dir)
+	out.mkdirs()
+	fmt.Fprintf(console, "Created "+out.ResourcesDir+" and "+out.OverridesDir+" directories\n")
+
+	cluster := loadCluster()
+	fmt.Fprintf(console, "Cluster YAML loaded into PKD\n")
+
+	if !checkCluster(cluster) {
+		return
 	}
 
-	createSSHSecret(cluster.MetaData.Name, cluster.MetaData.SshPrivateKey)
-	fmt.Printf("Created SSH Secret\n")
+	renderInventory(cluster, out)
+	renderClusterObjects(cluster, out)
+
+	fmt.Fprintln(console, "Rendered all resources to "+out.ResourcesDir+" and "+out.OverridesDir)
+	fmt.Fprintln(console, "Objects that only come from the dkp dry run, such as the PreprovisionedCluster and CNI ClusterResourceSets, are added during pkd up")
+}
+
+// ssh key secret and PreprovisionedInventory objects, these are applied before the rest of the cluster
+func renderInventory(cluster pkdCluster, out renderOutput) {
+
+	name := cluster.MetaData.Name
+	out.secret(name+"-ssh-key", generateSSHSecret(name, name+"-ssh-key", cluster.MetaData.SshPrivateKey))
+	fmt.Fprintf(console, "Generated SSH Secret\n")
+	//pools reached with a different key get their own secret
+	renderPoolSSHSecret := func(nodesetName string, pool NodePool) {
+		if secretName := sshSecretName(cluster.MetaData, nodesetName, pool); secretName != name+"-ssh-key" {
+			out.secret(secretName, generateSSHSecret(name, secretName, poolSSH(cluster.MetaData, pool).PrivateKey))
+			fmt.Fprintf(console, "Generated "+nodesetName+" SSH Secret\n")
+		}
+	}
+	renderPoolSSHSecret("control-plane", cluster.Controlplane)
 
 	//Create a ControlPlane PreProvisionedInventory Ojbect
-	genCPPI(cluster.MetaData, cluster.Controlplane)
-	fmt.Printf("Generated Control Plane PPI\n")
+	out.resource(name+"-control-plane-PreprovisionedInventory", genCPPI(cluster.MetaData, cluster.Controlplane))
+	fmt.Fprintf(console, "Generated Control Plane PPI\n")
 
 	//For Each NodePool, create a Preprovisioned Inventory Object
-	//mdval sets the machinedeployment name ie md-0
-	for nodesetName, nodes := range cluster.NodePools {
-		genPPI(cluster.MetaData, nodes, nodesetName)
-		fmt.Printf("Generated " + nodesetName + " PPI\n")
+	//mdval sets the machinedeployment name ie md-0, hosts with their own ssh settings get a nodeset of their own
+	nodesets := clusterNodesets(cluster)
+	for _, nodesetName := range sortedPoolNames(nodesets) {
+		nodes := nodesets[nodesetName]
+		renderPoolSSHSecret(nodesetName, nodes)
+		out.resource(name+"-"+nodesetName+"-PreprovisionedInventory", genPPI(cluster.MetaData, nodes, nodesetName))
+		fmt.Fprintf(console, "Generated "+nodesetName+" PPI\n")
 
 	}
+}
 
-	//apply the PreProvisionedInventory objects to the bootstrap cluster
-	applyPPI(cluster.MetaData.Name)
-	fmt.Printf("Applied all PPI\n")
+// every other object pkd owns, including the override secrets and the metal-lb configmap
+func renderClusterObjects(cluster pkdCluster, out renderOutput) {
+
+	name := cluster.MetaData.Name
+	out.resource(name+"-Cluster", generateCapiCluster(cluster))
+	out.resource("calico-cni-installation-"+name+"-ConfigMap", generateCalicoConfigMap(cluster))
+	out.secret(encryptionSecretName(name), generateEncryptionConfig(cluster))
+	if proxyHasCredentials(cluster.Proxy) {
+		dropIn := []byte(proxyDropIn(cluster))
+		out.secret(proxySecretName(name), generateSecret(name, proxySecretName(name), map[string][]byte{"http-proxy.conf": dropIn}))
+	}
+	if cluster.Audit.WebhookConfigFile != "" {
+		webhookConfig := []byte(readLocalFile(cluster.Audit.WebhookConfigFile))
+		out.secret(auditWebhookSecretName(name), generateSecret(name, auditWebhookSecretName(name), map[string][]byte{"webhook-config.yaml": webhookConfig}))
+	}
+	for _, registry := range clusterRegistries(cluster) {
+		if registry.CertFile != "" {
+			key := []byte(readLocalFile(registry.KeyFile))
+			secretName := registryClientKeySecretName(name, registry)
+			out.secret(secretName, generateSecret(name, secretName, map[string][]byte{"client.key": key}))
+		}
+	}
+	out.resource(name+"-control-plane-KubeadmControlPlane", generateKubeadmControlPlane(cluster))
+	out.resource(name+"-control-plane-PreprovisionedMachineTemplate", generateControlPlanePreprovisionedMachineTemplate(cluster))
+	renderOverride(cluster, "control-plane", cluster.Controlplane, out)
+
+	nodesets := clusterNodesets(cluster)
+	for _, nodesetName := range sortedPoolNames(nodesets) {
+		nodes := nodesets[nodesetName]
+		out.resource(name+"-"+nodesetName+"-PreprovisionedMachineTemplate", generatePreprovisionedMachineTemplate(cluster, nodesetName))
+		renderOverride(cluster, nodesetName, nodes, out)
+		out.resource(name+"-"+nodesetName+"-KubeadmConfigTemplate", generateKubeadmConfigTemplate(cluster, nodesetName, nodes))
+		out.resource(name+"-"+nodesetName+"-MachineDeployment", generateMachineDeployment(cluster, nodesetName, nodes))
+	}
+
+	out.resource(name+"-Metal-LB-ConfigMap", generateMlbConfigMap(cluster))
+}
+
+// the KIB override for a node pool and the secret its PreprovisionedMachineTemplate overrideRef points at
+func renderOverride(cluster pkdCluster, nodesetName string, nodes NodePool, out renderOutput) {
 
-	controlPlaneReplicas := strconv.Itoa(len(cluster.Controlplane.Hosts))
+	name := overrideName(cluster.MetaData.Name, nodesetName)
+	override := genOverride2_6_0(cluster, nodes)
+	out.override(name, override)
+	out.secret(name, generateSecret(cluster.MetaData.Name, name, map[string][]byte{"overrides.yaml": override}))
+}
 
-	//Generate the cluster.yaml dry run output
-	dkpDryRun(cluster.MetaData.Name, cluster.MetaData.KubeVipLoadbalancer, cluster.MetaData.InterfaceName, controlPlaneReplicas)
-	fmt.Printf("Dry Run Completed, Converting to Individual Objects\n")
+// split the dkp dry run output into a file per object under resources/
+func splitDryRun(cluster pkdCluster, out renderOutput) {
 
-	//Read in the Dry Run output and generate individual object file from it
-	dryRunOutput, err := os.Open(cluster.MetaData.Name + ".yaml")
+	clusterName := cluster.MetaData.Name
+	dryRunOutput, err := os.Open(clusterName + ".yaml")
 	if err != nil {
 		panic(err)
 	}
+	defer dryRunOutput.Close()
 	dryRunDecoder := yaml.NewDecoder(dryRunOutput)
 
 	// for each object in dry run, read it and convert to a yaml file
@@ -194,106 +455,35 @@ func up(modifier string) {
 		}
 		resourceName := spec.Metadata["name"].(string)
 		resourceKind := spec.Kind
-		fileName := "resources/" + resourceName + "-" + resourceKind + ".yaml"
+		//pkd generates the encryption config itself, see renderClusterObjects
+		if resourceKind == "Secret" && resourceName == encryptionSecretName(clusterName) {
+			continue
+		}
+		//an external load balancer serves the endpoint, kube-vip must not claim it as well
+		if resourceKind == "PreprovisionedCluster" && cluster.ControlPlaneEndpoint.External {
+			delete(spec.Spec, "virtualIP")
+		}
 		var file []byte
 
 		file, err = yaml.Marshal(&spec)
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = os.WriteFile(fileName, file, 0644)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-	}
-
-	generateCapiCluster(cluster)
-	generateCalicoConfigMap(cluster)
-	generateKubeadmControlPlane(cluster)
-	generateControlPlanePreprovisionedMachineTemplate(cluster)
-	generatePreprovisionedMachineTemplate(cluster)
-	generateKubeadmConfigTemplate(cluster)
-	generateMachineDeployment(cluster)
-
-	fmt.Printf("Generated all Custom Resources for NodePools\n")
-
-	//before we apply resources check for the pause flag, ie ./pkd up yee-haw
-	if modifier == "pause" {
-		r := bufio.NewReader(os.Stdin)
-		fmt.Println("Pausing, you can now manually edit objects in /resources before cluster creation")
-		input := true
-		for input {
-			fmt.Printf("Ready to continue? Type y or yes to confirm: ")
-
-			res, err := r.ReadString('\n')
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// Empty input (i.e. "\n")
-			if len(res) < 2 {
-				input = true
-			} else if strings.ToLower(strings.TrimSpace(res)) == "yes" || strings.ToLower(strings.TrimSpace(res)) == "y" {
-				input = false
-			}
-
+		if resourceKind == "Secret" {
+			out.secret(resourceName, file)
+		} else {
+			out.resource(resourceName+"-"+resourceKind, file)
 		}
 
 	}
-
-	//delete the Dry Run cluster YAML after we're done with it
-	//Moved till after the pause window in case you need to check it
-	err = os.Remove(cluster.MetaData.Name + ".yaml")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	applyResources(cluster.MetaData.Name)
-	fmt.Printf("Applied All Resources, Cluster Spinning Up\n")
-
-	timeout := "40"
-	if cluster.MetaData.KIBTimeout != "" {
-		timeout = cluster.MetaData.KIBTimeout
-	}
-	waitForClusterReady(cluster.MetaData.Name, timeout)
-	fmt.Printf("Cluster Is Ready\n")
-
-	getKubeconfig(cluster.MetaData.Name)
-	fmt.Printf("Grabbed the Kubeconfig\n")
-
-	if cluster.MetaData.PivotTimeout != "" {
-		timeout = cluster.MetaData.PivotTimeout
-	} else {
-		timeout = "20"
-	}
-	pivotCluster(cluster.MetaData.Name, timeout)
-	fmt.Printf("Pivoted the Cluster\n")
-
-	bootstrap("down")
-	fmt.Printf("Cleaned up the Bootstrap Cluster\n")
-
-	mergeKubeconfig(cluster.MetaData.Name)
-	fmt.Printf("Merged the Kubeconfig\n")
-
-	generateMlbConfigMap(cluster)
-	fmt.Printf("Applied Metal-LB ConfigMap\n\n")
-
-	if cluster.AirGap.Enabled {
-		fmt.Println("The DKP cluster has now been deployed. You can proceed to deploying Kommander via:\n\n" +
-			"./dkp install kommander --init --airgapped > install.yaml\n" +
-			"./dkp install kommander --installer-config install.yaml" +
-			" --kommander-applications-repository kommander-applications-" + cluster.MetaData.DKPversion + ".tar.gz" +
-			" --charts-bundle dkp-kommander-charts-bundle-" + cluster.MetaData.DKPversion + ".tar.gz")
-	} else {
-		fmt.Println("The DKP cluster has now been deployed. You can proceed to deploying Kommander via:\n\n" +
-			"./dkp install kommander --init > kommander.yaml\n" +
-			"./dkp install kommander --installer-config kommander.yaml")
-	}
 }
 
 func loadCluster() pkdCluster {
-	clusterYaml, err := os.ReadFile("cluster.yaml")
+	return loadClusterFile("cluster.yaml")
+}
+
+func loadClusterFile(path string) pkdCluster {
+	clusterYaml, err := os.ReadFile(path)
 
 	if err != nil {
 
@@ -312,6 +502,35 @@ func loadCluster() pkdCluster {
 
 		log.Fatal(err2)
 	}
+	//credentials may be kept out of cluster.yaml, ie password: ${env:REGISTRY_PASSWORD}
+	err = resolveClusterSecrets(&data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registerClusterSecrets(data)
+
+	//set defaults if not specified in cluster.yaml
+	//ensure that these subnets don't collide with metal-lb!
+	if data.MetaData.PodSubnet == "" {
+		data.MetaData.PodSubnet = "192.168.0.0/16"
+	}
+	if data.MetaData.ServiceSubnet == "" {
+		data.MetaData.ServiceSubnet = "10.96.0.0/12"
+	}
+	//older cluster.yaml files only set the kubernetes version for air gap seeding
+	if data.MetaData.K8sVersion == "" {
+		data.MetaData.K8sVersion = data.AirGap.K8sVersion
+	}
+	if data.MetaData.K8sVersion == "" {
+		data.MetaData.K8sVersion = defaultK8sVersion(data.MetaData.DKPversion)
+	}
+	data.MetaData.K8sVersion = normalizeK8sVersion(data.MetaData.K8sVersion)
+	if data.ControlPlaneEndpoint.Host == "" && !data.ControlPlaneEndpoint.External {
+		data.ControlPlaneEndpoint.Host = data.MetaData.KubeVipLoadbalancer
+	}
+	if data.ControlPlaneEndpoint.Port == 0 {
+		data.ControlPlaneEndpoint.Port = 6443
+	}
 
 	return data
 }
@@ -325,6 +544,7 @@ func initYaml() {
 		NodePools:    map[string]NodePool{},
 	}
 	exampleCluster.MetaData.DKPversion = "v2.6.0"
+	exampleCluster.MetaData.K8sVersion = "v1.26.6"
 	exampleCluster.MetaData.Name = "demo-cluster"
 	exampleCluster.MetaData.SshUser = "user"
 	exampleCluster.MetaData.SshPrivateKey = "id_rsa"
@@ -334,36 +554,37 @@ func initYaml() {
 	exampleCluster.MetaData.PivotTimeout = "20"
 	exampleCluster.MetaData.PodSubnet = "192.168.0.0/16"
 	exampleCluster.MetaData.ServiceSubnet = "10.96.0.0/12"
-	exampleCluster.MetaData.MetalAddressRange = "10.0.0.20-10.0.0.24"
+	exampleCluster.MetaData.MetalAddressRange = "10.0.0.30-10.0.0.34"
 	exampleCluster.AirGap.Enabled = false
 	exampleCluster.Registry.Host = "https://registry-1.docker.io"
-	exampleCluster.Registry.Username = "user"
-	exampleCluster.Registry.Password = "pass"
-	exampleCluster.Controlplane.Hosts = map[string]string{
-		"controlplane1": "10.0.0.11",
-		"controlplane2": "10.0.0.12",
-		"controlplane3": "10.0.0.13",
+	//left empty so the example loads without any environment, the docs show ${env:NAME} references
+	exampleCluster.Registry.Username = ""
+	exampleCluster.Registry.Password = ""
+	exampleCluster.Controlplane.Hosts = map[string]Host{
+		"controlplane1": {Address: "10.0.0.11"},
+		"controlplane2": {Address: "10.0.0.12"},
+		"controlplane3": {Address: "10.0.0.13"},
 	}
 	exampleCluster.Controlplane.Flags = map[string]bool{
 		"registry": true,
 	}
 	exampleCluster.NodePools = map[string]NodePool{
 		"md-0": {
-			Hosts: map[string]string{
-				"worker1": "10.0.0.14",
-				"worker2": "10.0.0.15",
-				"worker3": "10.0.0.16",
-				"worker4": "10.0.0.17",
-				"worker5": "10.0.0.18",
+			Hosts: map[string]Host{
+				"worker1": {Address: "10.0.0.14"},
+				"worker2": {Address: "10.0.0.15"},
+				"worker3": {Address: "10.0.0.16"},
+				"worker4": {Address: "10.0.0.17"},
+				"worker5": {Address: "10.0.0.18"},
 			},
 			Flags: map[string]bool{
 				"registry": true,
 			},
 		},
 		"md-1": {
-			Hosts: map[string]string{
-				"worker1": "10.0.0.19",
-				"worker2": "10.0.0.20",
+			Hosts: map[string]Host{
+				"worker1": {Address: "10.0.0.19"},
+				"worker2": {Address: "10.0.0.20"},
 			},
 			Flags: map[string]bool{
 				"registry": true,
@@ -390,6 +611,7 @@ func initAGYaml() {
 		NodePools:    map[string]NodePool{},
 	}
 	exampleCluster.MetaData.DKPversion = "v2.6.0"
+	exampleCluster.MetaData.K8sVersion = "v1.26.6"
 	exampleCluster.MetaData.Name = "demo-cluster"
 	exampleCluster.MetaData.SshUser = "user"
 	exampleCluster.MetaData.SshPrivateKey = "id_rsa"
@@ -399,32 +621,32 @@ func initAGYaml() {
 	exampleCluster.MetaData.PivotTimeout = "20"
 	exampleCluster.MetaData.PodSubnet = "192.168.0.0/16"
 	exampleCluster.MetaData.ServiceSubnet = "10.96.0.0/12"
-	exampleCluster.MetaData.MetalAddressRange = "10.0.0.20-10.0.0.24"
+	exampleCluster.MetaData.MetalAddressRange = "10.0.0.30-10.0.0.34"
 	exampleCluster.AirGap.Enabled = true
-	exampleCluster.AirGap.K8sVersion = "1.26.6"
 	exampleCluster.AirGap.OsVersion = "centos_7_x86_64"
 	exampleCluster.AirGap.ContainerdVersion = "centos-7.9-x86_64"
 	exampleCluster.AirGap.IncludePKD = true
 	exampleCluster.AirGap.PKDoS = "linux"
 	exampleCluster.Registry.Host = "https://registry-1.docker.io"
-	exampleCluster.Registry.Username = "user"
-	exampleCluster.Registry.Password = "pass"
-	exampleCluster.Controlplane.Hosts = map[string]string{
-		"controlplane1": "10.0.0.11",
-		"controlplane2": "10.0.0.12",
-		"controlplane3": "10.0.0.13",
+	//left empty so the example loads without any environment, the docs show ${env:NAME} references
+	exampleCluster.Registry.Username = ""
+	exampleCluster.Registry.Password = ""
+	exampleCluster.Controlplane.Hosts = map[string]Host{
+		"controlplane1": {Address: "10.0.0.11"},
+		"controlplane2": {Address: "10.0.0.12"},
+		"controlplane3": {Address: "10.0.0.13"},
 	}
 	exampleCluster.Controlplane.Flags = map[string]bool{
 		"registry": true,
 	}
 	exampleCluster.NodePools = map[string]NodePool{
 		"md-0": {
-			Hosts: map[string]string{
-				"worker1": "10.0.0.14",
-				"worker2": "10.0.0.15",
-				"worker3": "10.0.0.16",
-				"worker4": "10.0.0.17",
-				"worker5": "10.0.0.18",
+			Hosts: map[string]Host{
+				"worker1": {Address: "10.0.0.14"},
+				"worker2": {Address: "10.0.0.15"},
+				"worker3": {Address: "10.0.0.16"},
+				"worker4": {Address: "10.0.0.17"},
+				"worker5": {Address: "10.0.0.18"},
 			},
 			Flags: map[string]bool{
 				"registry": true,
@@ -444,77 +666,49 @@ func initAGYaml() {
 
 func bootstrap(str string) {
 	if str == "up" {
-		fmt.Printf("Creating Bootstrap Cluster\n")
+		fmt.Fprintf(console, "Creating Bootstrap Cluster\n")
 
-		cmd := exec.Command("./dkp", "create", "bootstrap")
-		//run the command
-		output, err := cmd.CombinedOutput()
-		fmt.Println(string(output))
+		err := os.MkdirAll(stateDir, os.ModePerm)
 		if err != nil {
 			log.Fatal(err)
 		}
+		run(newCommand("./dkp", "create", "bootstrap", "--kubeconfig", bootstrapKubeconfig))
 
 	} else if str == "down" {
-		fmt.Printf("Deleting Bootstrap Cluster\n")
+		fmt.Fprintf(console, "Deleting Bootstrap Cluster\n")
 
-		cmd := exec.Command("./dkp", "delete", "bootstrap")
-		//run the command
-		output, err := cmd.CombinedOutput()
-		fmt.Println(string(output))
-		if err != nil {
-			log.Fatal(err)
-		}
+		run(newCommand("./dkp", "delete", "bootstrap", "--kubeconfig", bootstrapKubeconfig))
 	}
 }
 
+// copy the clusters, users and contexts of <name>.conf into ~/.kube/config and switch to its context
 func mergeKubeconfig(clusterName string) {
 
-	mergedConfigs := "./" + clusterName + ".conf:" + os.Getenv("HOME") + "/.kube/config"
-	fmt.Println("Setting Environment Variable for kubeconfig to: \n  " + mergedConfigs)
-	os.Setenv("KUBECONFIG", mergedConfigs)
-
-	cmd1 := exec.Command("kubectl", "config", "view", "--flatten")
-	cmd1.Env = os.Environ()
-
-	// open the out file for writing
-	mergedKubeconfig, err := os.Create("./merged.conf")
-	if err != nil {
-		panic(err)
-	}
-	defer mergedKubeconfig.Close()
-	cmd1.Stdout = mergedKubeconfig
-	err = cmd1.Run()
+	merged := loadDefaultKubeconfig()
+	config, err := clientcmd.LoadFromFile(clusterName + ".conf")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = os.Chmod("merged.conf", 0600)
-	if err != nil {
-		log.Fatal(err)
+	//entries from the new cluster win over stale ones with the same name
+	for name, cluster := range config.Clusters {
+		merged.Clusters[name] = cluster
 	}
+	for name, user := range config.AuthInfos {
+		merged.AuthInfos[name] = user
+	}
+	for name, context := range config.Contexts {
+		merged.Contexts[name] = context
+	}
+	fmt.Fprintln(console, "Switching to Context: "+config.CurrentContext)
+	merged.CurrentContext = config.CurrentContext
 
-	start := "merged.conf"
-	destination := os.Getenv("HOME") + "/.kube/config"
-	os.Rename(start, destination)
-
-	cmd2 := exec.Command("kubectl", "config", "get-contexts", "--kubeconfig=./"+clusterName+".conf", "--output=name")
-
-	var outbuf, errbuf strings.Builder
-	cmd2.Stdout = &outbuf
-	cmd2.Stderr = &errbuf
-	err = cmd2.Run()
+	err = os.MkdirAll(filepath.Dir(defaultKubeconfig()), os.ModePerm)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	context := strings.TrimSuffix(outbuf.String(), "\n")
-	os.Setenv("KUBECONFIG", os.Getenv("HOME")+"/.kube/config")
-	fmt.Println("Switching to Context: " + context)
-
-	cmd3 := exec.Command("kubectl", "config", "use-context", context)
-	cmd3.Env = os.Environ()
-
-	err = cmd3.Run()
+	//WriteToFile keeps the kubeconfig readable only by us
+	err = clientcmd.WriteToFile(*merged, defaultKubeconfig())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -522,43 +716,15 @@ func mergeKubeconfig(clusterName string) {
 
 func getKubeconfig(clusterName string) {
 	//create the command
-	//./dkp get kubeconfig -c ${CLUSTER_NAME} > ${CLUSTER_NAME}.conf
-	cmd := exec.Command("./dkp", "get", "kubeconfig", "-c", clusterName)
-
-	//create the empty target file
-	kubeconfig, err := os.Create(clusterName + ".conf")
-	if err != nil {
-		panic(err)
-	}
-	defer kubeconfig.Close()
-
-	//dump the contents of our command into our empty file
-	cmd.Stdout = kubeconfig
-
-	var errb bytes.Buffer
-	cmd.Stderr = &errb
-	cmd.Run()
+	//./dkp get kubeconfig -c ${CLUSTER_NAME} --kubeconfig .pkd/bootstrap.conf > ${CLUSTER_NAME}.conf
+	kubeconfig, errb, err := runner.Output(newCommand("./dkp", "get", "kubeconfig", "-c", clusterName, "--kubeconfig", bootstrapKubeconfig))
+	printOutput(errb)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(errb.String())
-}
 
-func createSSHSecret(clusterName string, keyName string) {
-
-	//exec.Command("kubectl create secret generic " + cluster.MetaData.Name + "-ssh-key --from-file=ssh-privatekey=" + cluster.MetaData.SshPrivateKey)
-	//exec.Command("kubectl label secret " + cluster.MetaData.Name + "-ssh-key clusterctl.cluster.x-k8s.io/move=")
-
-	cmd := exec.Command("kubectl", "create", "secret", "generic", clusterName+"-ssh-key", "--from-file=ssh-privatekey="+keyName)
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	cmd = exec.Command("kubectl", "label", "secret", clusterName+"-ssh-key", "clusterctl.cluster.x-k8s.io/move=")
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
+	//dump the contents of our command into the target file
+	err = os.WriteFile(clusterName+".conf", kubeconfig, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -566,153 +732,139 @@ func createSSHSecret(clusterName string, keyName string) {
 
 func applyPPI(clusterName string) {
 
-	err := filepath.Walk("./resources/", func(path string, info os.FileInfo, err error) error {
+	client := mustKubeClient(bootstrapKubeconfig)
+	err := filepath.Walk(defaultOutput.ResourcesDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(console, err)
 			return err
 		}
 		//cluster-a-control-plane-PreprovisionedInventory.yaml
 		//
 		//
-		if strings.Contains(path, "-PreprovisionedInventory.yaml") && strings.Contains(path, clusterName) {
-			//kubectl apply -f <cluster-name>-PreProvisionedInventory.yaml
-			cmd := exec.Command("kubectl", "apply", "-f", path)
-			//run the command
-			err := cmd.Run()
-			if err != nil {
-				log.Fatal(err)
-			}
+		if (strings.Contains(path, "-PreprovisionedInventory.yaml") || strings.HasSuffix(path, "-ssh-key-Secret.yaml")) && strings.Contains(path, clusterName) {
+			//kubectl apply --server-side -f <cluster-name>-PreProvisionedInventory.yaml
+			applyFile(client, path)
 		}
 		return nil
 	})
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(console, err)
 	}
 }
 
-func dkpDryRun(clusterName string, clusterLoadBalancer string, interfaceName string, controlPlaneReplicas string) {
+func dkpDryRun(cluster pkdCluster) {
 
-	cmd := exec.Command(
-		"./dkp", "create", "cluster", "preprovisioned",
+	clusterName := cluster.MetaData.Name
+	endpoint := cluster.ControlPlaneEndpoint
+	//kube-vip claims the dry run's endpoint host, it needs the address even when clients use a DNS name
+	endpointHost := endpoint.Host
+	if !endpoint.External {
+		endpointHost = cluster.MetaData.KubeVipLoadbalancer
+	}
+	args := []string{"create", "cluster", "preprovisioned",
 		"--cluster-name", clusterName,
-		"--control-plane-endpoint-host", clusterLoadBalancer,
-		"--control-plane-replicas", controlPlaneReplicas,
-		"--virtual-ip-interface", interfaceName,
-		"--dry-run", "-o", "yaml")
-
-	//create the empty target file
-	clusteryaml, err := os.Create(clusterName + ".yaml")
+		"--control-plane-endpoint-host", endpointHost,
+		"--control-plane-endpoint-port", strconv.Itoa(endpoint.Port),
+		"--control-plane-replicas", strconv.Itoa(len(cluster.Controlplane.Hosts))}
+	//without a virtual ip interface dkp doesn't deploy kube-vip
+	if !endpoint.External {
+		args = append(args, "--virtual-ip-interface", cluster.MetaData.InterfaceName)
+	}
+	args = append(args, "--kubeconfig", bootstrapKubeconfig, "--dry-run", "-o", "yaml")
+	clusteryaml, errb, err := runner.Output(newCommand("./dkp", args...))
 	if err != nil {
-		panic(err)
+		printOutput(errb)
+		log.Fatal(err)
 	}
-	defer clusteryaml.Close()
-
-	//dump the contents of our command into our empty file
-	cmd.Stdout = clusteryaml
-	err = cmd.Run()
 
+	//dump the contents of our command into the target file
+	err = os.WriteFile(clusterName+".yaml", clusteryaml, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func applyResources(clusterName string) {
-	err := filepath.Walk("./resources/", func(path string, info os.FileInfo, err error) error {
+
+	client := mustKubeClient(bootstrapKubeconfig)
+	err := filepath.Walk(defaultOutput.ResourcesDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(console, err)
 			return err
 		}
-		if !strings.Contains(path, "-PreprovisionedInventory.yaml") && strings.Contains(path, clusterName) {
-			//kubectl create -f <cluster-name>-PreProvisionedInventory.yaml
-			//changed from apply to create because tigera throws an error via apply, too big
-			cmd := exec.Command("kubectl", "create", "-f", path)
-			//run the command
-			output, err := cmd.CombinedOutput()
-			fmt.Println(string(output))
-			if err != nil {
-				log.Fatal(err)
-			}
+		//the ssh key and PPI were applied by applyPPI, metal-lb is applied to the workload cluster later
+		if strings.Contains(path, "-PreprovisionedInventory.yaml") || strings.HasSuffix(path, "-ssh-key-Secret.yaml") || strings.HasSuffix(path, "-Metal-LB-ConfigMap.yaml") {
+			return nil
+		}
+		if strings.Contains(path, clusterName) {
+			//kubectl apply --server-side -f <cluster-name>-<object>.yaml
+			//tigera's ConfigMap is too big for client side apply, server side apply has no such limit
+			applyFile(client, path)
 		}
 		return nil
 	})
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(console, err)
 	}
 }
 
 func waitForClusterReady(clusterName string, kibTimeout string) {
 
-	//kubectl  wait --for=condition=Ready "cluster/${CLUSTER_NAME}" --timeout=40m
-	cmd := exec.Command("kubectl", "wait", "--for=condition=Ready", "clusters/"+clusterName, "--timeout="+kibTimeout+"m")
+	client := mustKubeClient(bootstrapKubeconfig)
 
-	//run the command
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
+	//kubectl  wait --for=condition=Ready "cluster/${CLUSTER_NAME}" --timeout=40m
+	err := client.waitForClusterCondition(clusterName, "Ready", minutes(kibTimeout))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Cluster " + clusterName + " did not become Ready: " + err.Error())
 	}
 	//give the user time to fix any machines stuck in pending
 
-	fmt.Printf("Waiting up to 1 hour for all machines to be ready\nTo check if your machines are stuck, use command:\n\n  kubectl get job,pod,machines\n\n")
-	cmd = exec.Command("kubectl", "wait", "--for=condition=Ready", "machine", "--all", "--timeout=60m")
-
-	//run the command
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
+	fmt.Fprintf(console, "Waiting up to 1 hour for all machines to be ready\nTo check if your machines are stuck, use command:\n\n  kubectl --kubeconfig "+bootstrapKubeconfig+" get job,pod,machines\n\n")
+	err = client.waitForMachinesReady(clusterName, time.Hour)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Machines did not become Ready: " + err.Error())
 	}
 }
 
-func pivotCluster(clusterName string, pivotTimeout string) {
+func pivotCluster(clusterName string) {
 	//#Pivot to the new cluster
 
 	// ./dkp create capi-components --kubeconfig ${CLUSTER_NAME}.conf
-	cmd := exec.Command("./dkp", "create", "capi-components", "--kubeconfig", clusterName+".conf")
+	run(newCommand("./dkp", "create", "capi-components", "--kubeconfig", clusterName+".conf"))
 
-	//run the command
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+	// ./dkp move capi-resources --from-kubeconfig .pkd/bootstrap.conf --to-kubeconfig ${CLUSTER_NAME}.conf
+	run(newCommand("./dkp", "move", "capi-resources", "--from-kubeconfig", bootstrapKubeconfig, "--to-kubeconfig", clusterName+".conf"))
+}
 
-	// ./dkp move capi-resources --to-kubeconfig ${CLUSTER_NAME}.conf
-	cmd = exec.Command("./dkp", "move", "capi-resources", "--to-kubeconfig", clusterName+".conf")
+// wait for the cluster to manage itself after pivotCluster
+func waitForPivot(clusterName string, pivotTimeout string) {
 
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+	client := mustKubeClient(clusterName + ".conf")
 
 	//kubectl --kubeconfig ${CLUSTER_NAME}.conf wait --for=condition=ControlPlaneReady "clusters/${CLUSTER_NAME}" --timeout=20m
-	cmd = exec.Command("kubectl", "--kubeconfig", clusterName+".conf", "wait", "--for=condition=ControlPlaneReady", "clusters/"+clusterName, "--timeout="+pivotTimeout+"m")
-
-	//run the command
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
+	err := client.waitForClusterCondition(clusterName, "ControlPlaneReady", minutes(pivotTimeout))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Cluster " + clusterName + " control plane did not become Ready after the pivot: " + err.Error())
 	}
 
 	//kubectl --kubeconfig ${CLUSTER_NAME}.conf wait --for=condition=Ready "cluster/${CLUSTER_NAME}" --timeout=40m
-	cmd = exec.Command("kubectl", "--kubeconfig", clusterName+".conf", "wait", "--for=condition=Ready", "clusters/"+clusterName, "--timeout=40m")
-
-	//run the command
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
+	err = client.waitForClusterCondition(clusterName, "Ready", 40*time.Minute)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal("Cluster " + clusterName + " did not become Ready after the pivot: " + err.Error())
 	}
 }
 
 // used to create the final AirGap Bundle
 func compress(downloadpath string, version string) {
 
-	var dirBuffer bytes.Buffer
+	// write the .tar.gz straight to disk, the bundle is far too large to hold in memory
+	fileToWrite, err := os.OpenFile("./AirGapBundle-dkp-"+version+".tar.gz", os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(0755))
+	if err != nil {
+		panic(err)
+	}
+	defer fileToWrite.Close()
 
-	gzipWriter := gzip.NewWriter(&dirBuffer)
+	gzipWriter := gzip.NewWriter(fileToWrite)
 	tarWriter := tar.NewWriter(gzipWriter)
 
 	tarBar := progressbar.DefaultBytes(
@@ -722,6 +874,9 @@ func compress(downloadpath string, version string) {
 
 	// walk through every file in the folder
 	if err := filepath.Walk(downloadpath, func(path string, info fs.FileInfo, funcErr error) error {
+		if funcErr != nil {
+			return funcErr
+		}
 
 		//This header represents either a file or directory
 		header, err := tar.FileInfoHeader(info, path)
@@ -742,96 +897,99 @@ func compress(downloadpath string, version string) {
 			if err != nil {
 				return err
 			}
+			defer data.Close()
 			if _, err := io.Copy(io.MultiWriter(tarWriter, tarBar), data); err != nil {
 				return err
 			}
 		}
 		return nil
 	}); err != nil {
-		fmt.Println(err)
+		log.Fatal(err)
 	}
 
 	if err := tarWriter.Close(); err != nil {
-		fmt.Println(err)
+		log.Fatal(err)
 	}
 	if err := gzipWriter.Close(); err != nil {
-		fmt.Println(err)
-	}
-
-	// write the .tar.gzip
-	fileToWrite, err := os.OpenFile("./AirGapBundle-dkp-"+version+".tar.gz", os.O_CREATE|os.O_RDWR, os.FileMode(0755))
-	if err != nil {
-		panic(err)
-	}
-
-	// Dump the byte buffer to a tar.gz file
-	if _, err := io.Copy(fileToWrite, &dirBuffer); err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	fmt.Printf("\n\nAirGap Bundle now available: AirGapBundle-dkp-" + version + ".tar.gz\n\n")
+	fmt.Fprintf(console, "\n\nAirGap Bundle now available: AirGapBundle-dkp-"+version+".tar.gz\n\n")
 
 }
 
+// Unpack a tar or tar.gz archive, ie the DKP Air Gap Bundle, into dest
 func decompress(src string, dest string) error {
+	if !strings.Contains(src, ".tar") {
+		return fmt.Errorf("%s is not in a compatible archive format, it must be either a tar or gzip archive", src)
+	}
 	f, err := os.Open(src)
 	if err != nil {
-		os.Exit(1)
+		return err
 	}
+	defer f.Close()
 
-	var tarReader *tar.Reader
-
+	var archive io.Reader = f
 	if strings.Contains(src, "tar.gz") {
 		gzf, err := gzip.NewReader(f)
 		if err != nil {
-			fmt.Println(err)
+			return fmt.Errorf("%s: %v", src, err)
 		}
-		tarReader = tar.NewReader(gzf)
-
-	} else if strings.Contains(src, ".tar") {
-		tarReader = tar.NewReader(f)
-	} else {
-		fmt.Println("Error: File is not in a compatible archive format")
-		fmt.Println("Must be either tar or gzip archive")
-
-		return err
+		defer gzf.Close()
+		archive = gzf
 	}
 
+	tarReader := tar.NewReader(archive)
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
-			break
+			return nil
 		}
-		if header.Typeflag == tar.TypeReg {
-			targetFile := filepath.Join(dest, header.Name)
-			cut := -1
-			if runtime.GOOS == "windows" {
-				cut = strings.LastIndex(targetFile, "\\")
-			} else {
-				cut = strings.LastIndex(targetFile, "/")
-			}
-			if cut == -1 {
-				fmt.Println("Error: no path separator in filepath for: " + targetFile)
-			} else {
-				err = os.MkdirAll(targetFile[0:cut], 0755)
-				if err != nil {
-					fmt.Println(err)
-				}
-				if _, err := os.Stat("targetFile"); os.IsNotExist(err) {
-					file, err := os.OpenFile(targetFile, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-					if err != nil {
-						return err
-					}
-					if _, err := io.Copy(file, tarReader); err != nil {
-						return err
-					}
-				}
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		target, err := extractPath(dest, header.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+		//the bundle only holds directories and regular files, anything else is skipped
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = extractFile(target, tarReader, os.FileMode(header.Mode).Perm())
 			}
 		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// where an archive entry is extracted to, entries that would land outside dest are rejected
+func extractPath(dest string, name string) (string, error) {
 
+	target := filepath.Join(dest, name)
+	rel, err := filepath.Rel(dest, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", name, dest)
 	}
+	return target, nil
+}
+
+// a rerun after an interrupted unpack overwrites the partial files it left behind
+func extractFile(path string, content io.Reader, perm os.FileMode) error {
 
-	f.Close()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
 
@@ -858,73 +1016,60 @@ func copy(src, dst string) error {
 	defer destination.Close()
 	_, err = io.Copy(destination, source)
 	if err != nil {
-		fmt.Printf("Failed to copy file: %s\n", err.Error())
+		fmt.Fprintf(console, "Failed to copy file: %s\n", err.Error())
 	}
 	return err
 }
 
-func seedRegistry(host string, user string, password string, version string) {
+func seedRegistry(registry Registry, version string) {
 
-	registryURL := strings.ReplaceAll(host, "https://", "")
-	registryURL = strings.ReplaceAll(registryURL, "http://", "")
+	dir := bundleDir(version)
+	registryURL := mustParseRegistry(registry.Host).Address()
+	//dkp push image-bundle only takes the password as a flag, it is masked wherever the command is shown
+	push := func(bundle string) {
+		args := []string{"push", "image-bundle", "--image-bundle", bundle, "--to-registry", registryURL, "--to-registry-username", registry.Username, "--to-registry-password", registry.Password}
+		if registry.CAFile != "" {
+			args = append(args, "--to-registry-ca-cert-file", registry.CAFile)
+		}
+		if registry.InsecureSkipVerify {
+			args = append(args, "--to-registry-insecure-skip-tls-verify")
+		}
+		run(newCommand("./dkp", args...))
+	}
 
 	//dkp-air-gapped-bundle_v2.6.0_linux_amd64/dkp-v2.6.0/container-images
 
-	fmt.Println("Pushing Konvoy Image Bundle to Registry")
+	fmt.Fprintln(console, "Pushing Konvoy Image Bundle to Registry")
 	// ./dkp push image-bundle --image-bundle konvoy-image-bundle.tar.gz --to-registry $DOCKER_REGISTRY_ADDRESS --to-registry-username testuser --to-registry-password
-	cmd := exec.Command("./dkp", "push", "image-bundle", "--image-bundle", bundleDir+"container-images/konvoy-image-bundle.tar.gz", "--to-registry", registryURL, "--to-registry-username", user, "--to-registry-password", password)
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Pushing Kommander Image Bundle to Registry")
+	push(dir + "container-images/konvoy-image-bundle.tar.gz")
+	fmt.Fprintln(console, "Pushing Kommander Image Bundle to Registry")
 	// ./dkp push image-bundle --image-bundle "kommander-image-bundle.tar.gz --to-registry $DOCKER_REGISTRY_ADDRESS --to-registry-username testuser --to-registry-password
-	cmd = exec.Command("./dkp", "push", "image-bundle", "--image-bundle", bundleDir+"container-images/kommander-image-bundle-"+version+".tar.gz", "--to-registry", registryURL, "--to-registry-username", user, "--to-registry-password", password)
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Pushing DKP Insights Image Bundle to Registry")
+	push(dir + "container-images/kommander-image-bundle-" + version + ".tar.gz")
+	fmt.Fprintln(console, "Pushing DKP Insights Image Bundle to Registry")
 	// ./dkp push image-bundle --image-bundle dkp-insights-image-bundle-v2.2.0.tar.gz --to-registry $DOCKER_REGISTRY_ADDRESS --to-registry-username testuser --to-registry-password
-	cmd = exec.Command("./dkp", "push", "image-bundle", "--image-bundle", bundleDir+"container-images/dkp-insights-image-bundle-"+version+".tar.gz", "--to-registry", registryURL, "--to-registry-username", user, "--to-registry-password", password)
-	output, err = cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+	push(dir + "container-images/dkp-insights-image-bundle-" + version + ".tar.gz")
 
 }
 
 func seedHosts(osVersion string, bundleOs string, cdVersion string, dkpVersion string) {
 
-	fmt.Println("Using Konvoy Image Builder to upload artifacts to hosts")
+	fmt.Fprintln(console, "Using Konvoy Image Builder to upload artifacts to hosts")
 
 	//	konvoy-image upload artifacts --container-images-dir=./artifacts/images/ \
 	//	--os-packages-bundle=./artifacts/"$VERSION"_"$BUNDLE_OS".tar.gz \
 	//	--pip-packages-bundle=./artifacts/pip-packages.tar.gz \
 	//	--containerd-bundle=artifacts/containerd-1.4.13-d2iq.1-"$CONTAINERD_OS".tar.gz
-	cmd := exec.Command("./konvoy-image", "upload", "artifacts", "--container-images-dir=artifacts/images/",
-		"--os-packages-bundle=artifacts/"+osVersion+"_"+bundleOs+".tar.gz",
-		"--pip-packages-bundle=artifacts/pip-packages.tar.gz",
-		"--containerd-bundle=artifacts/containerd-1.4.13-d2iq.1-"+cdVersion+".tar.gz")
-	cmd.Dir = (bundleDir + "/kib")
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+	cmd := newCommand("./konvoy-image", "upload", "artifacts", "--container-images-dir="+kibArtifactsDir+"/images/",
+		"--os-packages-bundle="+kibArtifactsDir+"/"+osPackagesBundle(osVersion, bundleOs),
+		"--pip-packages-bundle="+kibArtifactsDir+"/pip-packages.tar.gz",
+		"--containerd-bundle="+kibArtifactsDir+"/"+containerdBundle(cdVersion))
+	cmd.Dir = (bundleDir(dkpVersion) + "/kib")
+	run(cmd)
 
 }
 func loadBootstrapImage(version string) {
-	fmt.Println("Loading the konvoy bootstrap docker image from file")
+	fmt.Fprintln(console, "Loading the konvoy bootstrap docker image from file")
 	// docker load -i konvoy-bootstrap-image-v2.6.0.tar
-	cmd := exec.Command("docker", "load", "-i", bundleDir+"konvoy-bootstrap_image-"+version+".tar")
-	output, err := cmd.CombinedOutput()
-	fmt.Println(string(output))
-	if err != nil {
-		log.Fatal(err)
-	}
+	run(newCommand("docker", "load", "-i", bundleDir(version)+"konvoy-bootstrap_image-"+version+".tar"))
 
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+}
+
+func writeArchive(t *testing.T, path string, entries []tarEntry) {
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzipWriter := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Mode: 0644, Size: int64(len(entry.content))}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "bundle.tar.gz")
+	dest := filepath.Join(dir, "out")
+	writeArchive(t, archive, []tarEntry{
+		{name: "dkp-v2.6.0/", typeflag: tar.TypeDir},
+		{name: "dkp-v2.6.0/kib/empty/", typeflag: tar.TypeDir},
+		{name: "dkp-v2.6.0/kib/artifacts/pip-packages.tar.gz", typeflag: tar.TypeReg, content: "pip"},
+	})
+	//a partial file left by an interrupted unpack is overwritten, not appended to
+	stale := filepath.Join(dest, "dkp-v2.6.0/kib/artifacts/pip-packages.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("left over from an earlier unpack"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decompress(archive, dest); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "pip" {
+		t.Errorf("pip-packages.tar.gz holds %q, want %q", content, "pip")
+	}
+	if stat, err := os.Stat(filepath.Join(dest, "dkp-v2.6.0/kib/empty")); err != nil || !stat.IsDir() {
+		t.Errorf("directory entry was not created: %v", err)
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	slip := filepath.Join(dir, "slip.tar.gz")
+	writeArchive(t, slip, []tarEntry{
+		{name: "dkp-v2.6.0/../../escaped", typeflag: tar.TypeReg, content: "x"},
+	})
+	corrupt := filepath.Join(dir, "corrupt.tar.gz")
+	if err := os.WriteFile(corrupt, []byte(strings.Repeat("not gzip", 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.tar")
+	if err := os.WriteFile(truncated, []byte(strings.Repeat("x", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		archive string
+		err     string
+	}{
+		{name: "entry outside dest", archive: slip, err: "is outside of"},
+		{name: "not gzip", archive: corrupt, err: "gzip"},
+		{name: "truncated tar", archive: truncated, err: "unexpected EOF"},
+		{name: "missing archive", archive: filepath.Join(dir, "missing.tar.gz"), err: "no such file"},
+		{name: "not an archive", archive: filepath.Join(dir, "bundle.zip"), err: "not in a compatible archive format"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dest := filepath.Join(dir, "out")
+			err := decompress(test.archive, dest)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("decompress(%s) = %v, want an error containing %q", filepath.Base(test.archive), err, test.err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("an entry was written outside of the destination")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+func proxyEnabled(proxy Proxy) bool {
+	return proxy.HTTPProxy != "" || proxy.HTTPSProxy != ""
+}
+
+// a proxy URL with a user and password, validateCluster has already checked both parse
+func proxyHasCredentials(proxy Proxy) bool {
+	for _, proxyURL := range []string{proxy.HTTPProxy, proxy.HTTPSProxy} {
+		if u, err := url.Parse(proxyURL); err == nil && u.User != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// drop-ins carrying the proxy credentials are kept in a secret rather than inline in the templates
+func proxySecretName(clusterName string) string {
+	return clusterName + "-proxy-config"
+}
+
+// Everything the nodes must reach directly: the loopback, both cluster networks, in cluster
+// service names, every host, kube-vip and the control plane endpoint, then anything cluster.yaml adds
+func noProxy(cluster pkdCluster) []string {
+
+	entries := []string{
+		"localhost",
+		"127.0.0.1",
+		cluster.MetaData.PodSubnet,
+		cluster.MetaData.ServiceSubnet,
+		"kubernetes",
+		"kubernetes.default",
+		".svc",
+		".svc.cluster.local",
+		".cluster.local",
+	}
+	for _, pool := range allPools(cluster) {
+		for _, name := range orderedHosts(pool) {
+			entries = append(entries, pool.Hosts[name].Address)
+		}
+	}
+	entries = append(entries, cluster.MetaData.KubeVipLoadbalancer, cluster.ControlPlaneEndpoint.Host)
+	entries = append(entries, cluster.Proxy.NoProxy...)
+
+	unique := []string{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry != "" && !seen[entry] {
+			unique = append(unique, entry)
+			seen[entry] = true
+		}
+	}
+	return unique
+}
+
+// systemd drop-ins giving containerd and the kubelet the proxy settings,
+// the daemon-reload and containerd restart in preKubeadmCommands pick them up
+func proxyFiles(cluster pkdCluster) []KubeadmFile {
+
+	if !proxyEnabled(cluster.Proxy) {
+		return nil
+	}
+	files := []KubeadmFile{}
+	for _, service := range []string{"containerd", "kubelet"} {
+		file := KubeadmFile{
+			Path:        "/etc/systemd/system/" + service + ".service.d/http-proxy.conf",
+			Permissions: "0644",
+		}
+		if proxyHasCredentials(cluster.Proxy) {
+			file.Permissions = "0600"
+			file.ContentFrom.Secret.Name = proxySecretName(cluster.MetaData.Name)
+			file.ContentFrom.Secret.Key = "http-proxy.conf"
+		} else {
+			file.Content = proxyDropIn(cluster)
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// the [Service] environment shared by the containerd and kubelet drop-ins
+func proxyDropIn(cluster pkdCluster) string {
+
+	env := "[Service]\n"
+	if cluster.Proxy.HTTPProxy != "" {
+		env += "Environment=\"HTTP_PROXY=" + cluster.Proxy.HTTPProxy + "\"\n"
+	}
+	if cluster.Proxy.HTTPSProxy != "" {
+		env += "Environment=\"HTTPS_PROXY=" + cluster.Proxy.HTTPSProxy + "\"\n"
+	}
+	env += "Environment=\"NO_PROXY=" + strings.Join(noProxy(cluster), ",") + "\"\n"
+	return env
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+const redacted = "********"
+
+// Secret values from cluster.yaml that must never reach the terminal or CI logs. Anything pkd
+// prints from a child process, and everything written through log, is passed through redact
+var secretValues = []string{}
+
+// Values this short would mask ordinary words and numbers all over the output
+const minSecretLength = 4
+
+func registerSecret(value string) {
+
+	if len(value) < minSecretLength {
+		return
+	}
+	for _, known := range secretValues {
+		if known == value {
+			return
+		}
+	}
+	secretValues = append(secretValues, value)
+	//longest first, so a secret containing another is masked whole
+	sort.Slice(secretValues, func(i, j int) bool { return len(secretValues[i]) > len(secretValues[j]) })
+}
+
+// the resolved registry passwords and proxy passwords of a cluster
+func registerClusterSecrets(cluster pkdCluster) {
+
+	for _, registry := range clusterRegistries(cluster) {
+		if registry.Password == "" {
+			continue
+		}
+		registerSecret(registry.Password)
+		//docker config.json auths and basic auth headers carry them base64 encoded, alone or as user:password
+		registerSecret(base64.StdEncoding.EncodeToString([]byte(registry.Password)))
+		registerSecret(base64.StdEncoding.EncodeToString([]byte(registry.Username + ":" + registry.Password)))
+	}
+	for _, proxy := range []string{cluster.Proxy.HTTPProxy, cluster.Proxy.HTTPSProxy} {
+		if u, err := url.Parse(proxy); err == nil && u.User != nil {
+			password, _ := u.User.Password()
+			registerSecret(password)
+		}
+	}
+}
+
+func redact(text string) string {
+	for _, value := range secretValues {
+		text = strings.ReplaceAll(text, value, redacted)
+	}
+	return text
+}
+
+// log.SetOutput(redactingWriter{os.Stderr}) masks secrets in every log.Fatal, log writes
+// each message in a single call so a secret is never split across writes
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(r.w, redact(string(p)))
+	return len(p), err
+}
+
+// Everything pkd prints goes to console rather than straight to os.Stdout, so a secret in a
+// value from cluster.yaml is masked like it is in log messages
+var console io.Writer = redactingWriter{os.Stdout}
+
+// print what a child process wrote, dkp and docker can echo registry credentials back in errors
+func printOutput(output []byte) {
+	fmt.Fprintln(console, string(output))
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// containerd looks up registry settings in /etc/containerd/certs.d/<host>/hosts.toml
+const containerdCertsDir = "/etc/containerd/certs.d"
+
+// A registry host from cluster.yaml, ie https://harbor.example.com/project, broken
+// into the parts KIB, containerd and dkp each expect
+type registryEndpoint struct {
+	Scheme string
+	//host[:port], IPv6 addresses in brackets
+	Host string
+	//project or repository path without the /v2 api prefix, ie /project, empty for none
+	Path string
+}
+
+// Parse a registry host with or without its scheme, https is assumed when it is missing.
+// Bare IPv6 addresses may be written without brackets as long as they have no port
+func parseRegistry(host string) (registryEndpoint, error) {
+
+	raw := strings.TrimSpace(host)
+	if raw == "" {
+		return registryEndpoint{}, errors.New("registry host is empty")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	scheme := raw[:strings.Index(raw, "://")]
+	rest := raw[len(scheme)+3:]
+	authority := strings.SplitN(rest, "/", 2)[0]
+	if ip := net.ParseIP(authority); ip != nil && ip.To4() == nil {
+		raw = scheme + "://[" + authority + "]" + rest[len(authority):]
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return registryEndpoint{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return registryEndpoint{}, fmt.Errorf("%q must use http or https", host)
+	}
+	if u.Hostname() == "" {
+		return registryEndpoint{}, fmt.Errorf("%q has no host", host)
+	}
+	if u.User != nil {
+		return registryEndpoint{}, fmt.Errorf("%q must not contain credentials, set username and password instead", host)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return registryEndpoint{}, fmt.Errorf("%q must not have a query or fragment", host)
+	}
+
+	path := strings.Trim(u.Path, "/")
+	if path == "v2" || strings.HasPrefix(path, "v2/") {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "v2"), "/")
+	}
+	endpoint := registryEndpoint{Scheme: u.Scheme, Host: strings.ToLower(u.Host)}
+	if path != "" {
+		endpoint.Path = "/" + path
+	}
+	return endpoint, nil
+}
+
+// validateCluster has already checked every registry host parses
+func mustParseRegistry(host string) registryEndpoint {
+	endpoint, err := parseRegistry(host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return endpoint
+}
+
+// scheme://host[:port], the server containerd talks to
+func (e registryEndpoint) Server() string {
+	return e.Scheme + "://" + e.Host
+}
+
+// The URL KIB configures as a mirror. containerd adds /v2 to bare hosts itself,
+// but a project path has to be given under /v2, ie https://harbor.example.com/v2/project
+func (e registryEndpoint) MirrorURL() string {
+	if e.Path == "" {
+		return e.Server()
+	}
+	return e.Server() + "/v2" + e.Path
+}
+
+// host[:port]/project without a scheme, as dkp push image-bundle --to-registry takes it
+func (e registryEndpoint) Address() string {
+	return e.Host + e.Path
+}
+
+// the name containerd knows a registry by, docker hub is always docker.io
+func (e registryEndpoint) ContainerdName() string {
+	if e.Host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return e.Host
+}
+
+func registryTLSEnabled(registry Registry) bool {
+	return registry.CAFile != "" || registry.CertFile != "" || registry.InsecureSkipVerify
+}
+
+// An air gapped registry section that doesn't list its mirrors stands in for docker.io and everything else
+func primaryRegistry(cluster pkdCluster) Registry {
+
+	registry := cluster.Registry
+	if cluster.AirGap.Enabled && registry.Host != "" && len(registry.Mirrors) == 0 {
+		registry.Mirrors = []string{"docker.io", "*"}
+	}
+	return registry
+}
+
+// every registry in cluster.yaml, the registry section first followed by registries
+func clusterRegistries(cluster pkdCluster) []Registry {
+
+	registries := []Registry{}
+	if cluster.Registry.Host != "" {
+		registries = append(registries, primaryRegistry(cluster))
+	}
+	return append(registries, cluster.Registries...)
+}
+
+// the registry air gap image bundles are pushed to, the one mirroring everything if there is one
+func airGapRegistry(cluster pkdCluster) Registry {
+
+	registries := clusterRegistries(cluster)
+	for _, registry := range registries {
+		for _, mirrored := range registry.Mirrors {
+			if mirrored == "*" {
+				return registry
+			}
+		}
+	}
+	if len(registries) > 0 {
+		return registries[0]
+	}
+	return Registry{}
+}
+
+// the client key for a mutual TLS registry is kept in a secret rather than inline in the templates
+func registryClientKeySecretName(clusterName string, registry Registry) string {
+	name := strings.NewReplacer(".", "-", ":", "-", "[", "", "]", "").Replace(mustParseRegistry(registry.Host).ContainerdName())
+	return clusterName + "-registry-" + name + "-client-key"
+}
+
+// The CA, client certificate and a hosts.toml telling containerd to use them for every registry
+// with TLS settings, written to every node so the first image pull trusts a private CA
+func registryFiles(cluster pkdCluster) []KubeadmFile {
+
+	files := []KubeadmFile{}
+	for _, registry := range clusterRegistries(cluster) {
+		files = append(files, registryTLSFiles(cluster.MetaData.Name, registry)...)
+	}
+	return files
+}
+
+func registryTLSFiles(clusterName string, registry Registry) []KubeadmFile {
+
+	if !registryTLSEnabled(registry) {
+		return nil
+	}
+	endpoint := mustParseRegistry(registry.Host)
+	dir := registryCertsDir(endpoint)
+	server := endpoint.Server()
+	files := []KubeadmFile{}
+	//the same certificates are used whether the registry is pulled from directly or as a mirror
+	tlsSettings := ""
+
+	if registry.CAFile != "" {
+		files = append(files, KubeadmFile{Content: readLocalFile(registry.CAFile), Path: dir + "/ca.crt", Permissions: "0644"})
+		tlsSettings += fmt.Sprintf("  ca = %q\n", dir+"/ca.crt")
+	}
+	if registry.CertFile != "" {
+		files = append(files, KubeadmFile{Content: readLocalFile(registry.CertFile), Path: dir + "/client.crt", Permissions: "0644"})
+		key := KubeadmFile{Path: dir + "/client.key", Permissions: "0600"}
+		key.ContentFrom.Secret.Name = registryClientKeySecretName(clusterName, registry)
+		key.ContentFrom.Secret.Key = "client.key"
+		files = append(files, key)
+		tlsSettings += fmt.Sprintf("  client = [[%q, %q]]\n", dir+"/client.crt", dir+"/client.key")
+	}
+	if registry.InsecureSkipVerify {
+		tlsSettings += "  skip_verify = true\n"
+	}
+	hostsToml := fmt.Sprintf("server = %q\n\n[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n", server, server) + tlsSettings
+	files = append(files, KubeadmFile{Content: hostsToml, Path: dir + "/hosts.toml", Permissions: "0644"})
+
+	//Each mirrored registry gets a hosts.toml pointing at this one, replacing the one KIB writes
+	//for default_image_registry_mirrors, which doesn't know about the certificates
+	for _, mirrored := range registry.Mirrors {
+		mirrorDir := mirrorCertsDir(mirrored)
+		if mirrorDir == dir {
+			continue
+		}
+		mirrorToml := ""
+		if mirrored == "docker.io" {
+			mirrorToml += "server = \"https://registry-1.docker.io\"\n\n"
+		} else if mirrored != "*" {
+			mirrorToml += fmt.Sprintf("server = %q\n\n", "https://"+mirrored)
+		}
+		mirrorToml += fmt.Sprintf("[host.%q]\n  capabilities = [\"pull\", \"resolve\"]\n", endpoint.MirrorURL()) + tlsSettings
+		//MirrorURL already has the /v2 prefix containerd would otherwise add in front of the project path
+		if endpoint.Path != "" {
+			mirrorToml += "  override_path = true\n"
+		}
+		files = append(files, KubeadmFile{Content: mirrorToml, Path: mirrorDir + "/hosts.toml", Permissions: "0644"})
+	}
+	return files
+}
+
+// the certs.d directory of a registry pulled from directly
+func registryCertsDir(endpoint registryEndpoint) string {
+	return containerdCertsDir + "/" + endpoint.ContainerdName()
+}
+
+// the certs.d directory of a mirrored registry, containerd uses _default for any registry without one
+func mirrorCertsDir(mirrored string) string {
+	if mirrored == "*" {
+		return containerdCertsDir + "/_default"
+	}
+	return containerdCertsDir + "/" + mirrored
+}
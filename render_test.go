@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// go test -run TestRenderGolden -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Every manifest pkd render writes for a fixture, one after the other in path order
+func renderGolden(t *testing.T, clusterFile string) []byte {
+
+	cluster := loadClusterFile(clusterFile)
+	if !checkCluster(cluster) {
+		t.Fatalf("%s does not pass pkd validate", clusterFile)
+	}
+	out := memoryOutput()
+	renderInventory(cluster, out)
+	renderClusterObjects(cluster, out)
+	if len(out.Files) == 0 {
+		t.Fatalf("%s rendered nothing", clusterFile)
+	}
+
+	paths := []string{}
+	for path := range out.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var golden bytes.Buffer
+	for i, path := range paths {
+		if i > 0 {
+			golden.WriteString("---\n")
+		}
+		golden.WriteString("# " + path + "\n")
+		golden.Write(out.Files[path])
+	}
+	return golden.Bytes()
+}
+
+func TestRenderGolden(t *testing.T) {
+
+	fixtures := []string{"single-cp", "ha", "multi-pool", "gpu", "airgap", "custom-cidrs",
+		"per-host", "pool-files", "oidc-audit", "external-endpoint", "proxy", "registry-tls"}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture, func(t *testing.T) {
+			got := renderGolden(t, filepath.Join("testdata", fixture+".yaml"))
+			goldenFile := filepath.Join("testdata", fixture+".golden")
+			if *update {
+				err := os.WriteFile(goldenFile, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatalf("%v, run go test -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("rendered output differs from %s, run go test -update if the change is intended\n%s", goldenFile, firstDifference(string(got), string(want)))
+			}
+		})
+	}
+}
+
+// the first line that differs, a whole cluster's manifests are too much to print
+func firstDifference(got string, want string) string {
+
+	gotLines := strings.Split(got, "\n")
+	wantLines := strings.Split(want, "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		gotLine, wantLine := "<end of output>", "<end of output>"
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if gotLine != wantLine {
+			return "line " + strconv.Itoa(i+1) + ":\n  got:  " + gotLine + "\n  want: " + wantLine
+		}
+	}
+	return ""
+}
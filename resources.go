@@ -1,15 +1,128 @@
 package main
 
 type pkdCluster struct {
-	MetaData     MetaData
-	AirGap       AirGap
-	Registry     Registry
+	MetaData MetaData
+	AirGap   AirGap
+	Registry Registry
+	//further registries, each with its own credentials, TLS settings and the registries it mirrors
+	Registries   []Registry `yaml:"registries,omitempty"`
 	Controlplane NodePool
 	NodePools    map[string]NodePool
+	ExtraArgs    ExtraArgs `yaml:"extraargs,omitempty"`
+	OIDC         OIDC      `yaml:"oidc,omitempty"`
+	Audit        Audit     `yaml:"audit,omitempty"`
+	//where clients reach the api server, metadata.kubeviploadbalancer on port 6443 by default
+	ControlPlaneEndpoint ControlPlaneEndpoint `yaml:"controlplaneendpoint,omitempty"`
+	Proxy                Proxy                `yaml:"proxy,omitempty"`
 }
 type NodePool struct {
-	Hosts map[string]string
-	Flags map[string]bool
+	Hosts      map[string]Host
+	Flags      map[string]bool
+	K8sVersion string            `yaml:"k8sversion,omitempty"`
+	Labels     map[string]string `yaml:"labels,omitempty"`
+	Taints     []Taint           `yaml:"taints,omitempty"`
+	//appended to the files and commands pkd generates for every node in the pool
+	Files               []PoolFile `yaml:"files,omitempty"`
+	PreKubeadmCommands  []string   `yaml:"prekubeadmcommands,omitempty"`
+	PostKubeadmCommands []string   `yaml:"postkubeadmcommands,omitempty"`
+	//merged over the kubelet flags pkd sets, ie max-pods: "200"
+	KubeletExtraArgs map[string]string `yaml:"kubeletextraargs,omitempty"`
+	//control plane only, the host kubeadm init runs on
+	InitHost string `yaml:"inithost,omitempty"`
+}
+type Host struct {
+	Address       string            `yaml:"address"`
+	Port          int               `yaml:"port,omitempty"`
+	User          string            `yaml:"user,omitempty"`
+	SshPrivateKey string            `yaml:"sshprivatekey,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+}
+
+// same shape as a kubeadm nodeRegistration taint
+type Taint struct {
+	Key    string `yaml:"key"`
+	Value  string `yaml:"value,omitempty"`
+	Effect string `yaml:"effect"`
+}
+
+// Flags for the control plane components, merged over the ones pkd sets. Keys are flag
+// names with or without the leading --, ie feature-gates or --tls-cipher-suites
+type ExtraArgs struct {
+	APIServer         map[string]string `yaml:"apiserver,omitempty"`
+	ControllerManager map[string]string `yaml:"controllermanager,omitempty"`
+	Scheduler         map[string]string `yaml:"scheduler,omitempty"`
+	Etcd              map[string]string `yaml:"etcd,omitempty"`
+}
+
+// OpenID Connect provider the API server authenticates users against, ie Dex or Keycloak
+type OIDC struct {
+	IssuerURL      string `yaml:"issuerurl,omitempty"`
+	ClientID       string `yaml:"clientid,omitempty"`
+	UsernameClaim  string `yaml:"usernameclaim,omitempty"`
+	UsernamePrefix string `yaml:"usernameprefix,omitempty"`
+	GroupsClaim    string `yaml:"groupsclaim,omitempty"`
+	GroupsPrefix   string `yaml:"groupsprefix,omitempty"`
+	//local path to the CA that signed the issuer's certificate, when it isn't publicly trusted
+	CAFile string `yaml:"cafile,omitempty"`
+}
+
+// The control plane endpoint is served by kube-vip on metadata.kubeviploadbalancer unless it
+// is external, in which case a load balancer we don't manage forwards host:port to the control planes
+type ControlPlaneEndpoint struct {
+	Host     string   `yaml:"host,omitempty"`
+	Port     int      `yaml:"port,omitempty"`
+	CertSANs []string `yaml:"certsans,omitempty"`
+	External bool     `yaml:"external,omitempty"`
+}
+
+// HTTP proxy the hosts reach the internet or registry through. The cluster's own networks,
+// hosts and endpoint are always added to noproxy
+type Proxy struct {
+	HTTPProxy  string   `yaml:"httpproxy,omitempty"`
+	HTTPSProxy string   `yaml:"httpsproxy,omitempty"`
+	NoProxy    []string `yaml:"noproxy,omitempty"`
+}
+
+// API server auditing, anything left unset keeps pkd's default policy and retention
+type Audit struct {
+	//local path to an audit.k8s.io/v1 Policy
+	PolicyFile string `yaml:"policyfile,omitempty"`
+	MaxAge     *int   `yaml:"maxage,omitempty"`
+	MaxBackup  *int   `yaml:"maxbackup,omitempty"`
+	MaxSize    *int   `yaml:"maxsize,omitempty"`
+	//local path to a kubeconfig describing the webhook audit events are also sent to
+	WebhookConfigFile string `yaml:"webhookconfigfile,omitempty"`
+	WebhookMode       string `yaml:"webhookmode,omitempty"`
+}
+
+// A file written to every node of a pool before kubeadm runs. Its content is given inline,
+// read from a local file when the objects are rendered, or taken from a Secret in the
+// bootstrap cluster's default namespace
+type PoolFile struct {
+	Path        string      `yaml:"path"`
+	Permissions string      `yaml:"permissions,omitempty"`
+	Owner       string      `yaml:"owner,omitempty"`
+	Content     string      `yaml:"content,omitempty"`
+	File        string      `yaml:"file,omitempty"`
+	Secret      *FileSecret `yaml:"secret,omitempty"`
+}
+type FileSecret struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+}
+
+// a file in a kubeadm config spec, shared by the KubeadmControlPlane and KubeadmConfigTemplate
+type KubeadmFile struct {
+	Content     string `yaml:"content,omitempty"`
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	ContentFrom struct {
+		Secret struct {
+			Key  string `yaml:"key"`
+			Name string `yaml:"name"`
+		} `yaml:"secret"`
+	} `yaml:"contentFrom,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
 }
 type AirGap struct {
 	Enabled           bool   `yaml:"enabled"`
@@ -19,8 +132,24 @@ type AirGap struct {
 	IncludePKD        bool   `yaml:"includepkd,omitempty"`
 	PKDoS             string `yaml:"pkdos,omitempty"`
 }
+
+// written to manifest.yaml at the root of the air gap bundle
+type airGapManifest struct {
+	PKDVersion        string       `yaml:"pkdversion"`
+	DKPVersion        string       `yaml:"dkpversion"`
+	K8sVersion        string       `yaml:"k8sversion"`
+	OsVersion         string       `yaml:"osversion"`
+	ContainerdVersion string       `yaml:"containerdversion"`
+	Files             []airGapFile `yaml:"files"`
+}
+type airGapFile struct {
+	Path   string `yaml:"path"`
+	Size   int64  `yaml:"size"`
+	Sha256 string `yaml:"sha256"`
+}
 type MetaData struct {
 	DKPversion          string `yaml:"dkpversion"`
+	K8sVersion          string `yaml:"k8sversion,omitempty"`
 	Name                string `yaml:"name"`
 	SshUser             string `yaml:"sshuser"`
 	SshPrivateKey       string `yaml:"sshprivatekey"`
@@ -31,11 +160,39 @@ type MetaData struct {
 	PodSubnet           string `yaml:"podsubnet"`
 	ServiceSubnet       string `yaml:"servicesubnet"`
 	MetalAddressRange   string `yaml:"metaladdressrange"`
+	EncryptionKeyFile   string `yaml:"encryptionkeyfile,omitempty"`
+}
+
+// A registry KIB configures containerd for while it prepares a host. The TLS settings
+// carry the PEM content itself, KIB runs on the host and can't read our local files
+type kibRegistry struct {
+	Host          string `yaml:"host,omitempty"`
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+	Auth          string `yaml:"auth,omitempty"`
+	IdentityToken string `yaml:"identityToken,omitempty"`
+	TLS           *struct {
+		CACert             string `yaml:"caCert,omitempty"`
+		ClientCert         string `yaml:"clientCert,omitempty"`
+		ClientKey          string `yaml:"clientKey,omitempty"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify,omitempty"`
+	} `yaml:"tls,omitempty"`
 }
 type Registry struct {
 	Host     string `yaml:"host,omitempty"`
 	Username string `yaml:"username,omitempty"`
 	Password string `yaml:"password,omitempty"`
+	//docker config.json to look the credentials up in when username and password are empty
+	DockerConfig string `yaml:"dockerconfig,omitempty"`
+	//registries whose images are pulled from this one instead, ie docker.io, quay.io or * for all
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	//local paths to the CA that signed the registry's certificate and an optional client
+	//certificate and key for registries that require mutual TLS
+	CAFile   string `yaml:"cafile,omitempty"`
+	CertFile string `yaml:"certfile,omitempty"`
+	KeyFile  string `yaml:"keyfile,omitempty"`
+	//skip verifying the registry's certificate entirely, only for testing
+	InsecureSkipVerify bool `yaml:"insecureskipverify,omitempty"`
 }
 
 type Inventory struct {
@@ -51,6 +208,10 @@ type Inventory struct {
 
 type AnsibleHost struct {
 	AnsibleHost string `yaml:"ansible_host"`
+	//only set when the host differs from the inventory vars
+	AnsibleUser              string `yaml:"ansible_user,omitempty"`
+	AnsiblePort              int    `yaml:"ansible_port,omitempty"`
+	AnsibleSSHPrivateKeyFile string `yaml:"ansible_ssh_private_key_file,omitempty"`
 }
 
 type KubeadmControlPlane struct {
@@ -64,15 +225,8 @@ type KubeadmControlPlane struct {
 		KubeadmConfigSpec struct {
 			ClusterConfiguration struct {
 				APIServer struct {
-					ExtraArgs struct {
-						AuditLogMaxage           string `yaml:"audit-log-maxage"`
-						AuditLogMaxbackup        string `yaml:"audit-log-maxbackup"`
-						AuditLogMaxsize          string `yaml:"audit-log-maxsize"`
-						AuditLogPath             string `yaml:"audit-log-path"`
-						AuditPolicyFile          string `yaml:"audit-policy-file"`
-						CloudProvider            string `yaml:"cloud-provider"`
-						EncryptionProviderConfig string `yaml:"encryption-provider-config"`
-					} `yaml:"extraArgs"`
+					CertSANs     []string          `yaml:"certSANs,omitempty"`
+					ExtraArgs    map[string]string `yaml:"extraArgs"`
 					ExtraVolumes []struct {
 						HostPath  string `yaml:"hostPath"`
 						MountPath string `yaml:"mountPath"`
@@ -80,61 +234,44 @@ type KubeadmControlPlane struct {
 					} `yaml:"extraVolumes"`
 				} `yaml:"apiServer"`
 				ControllerManager struct {
-					ExtraArgs struct {
-						CloudProvider       string `yaml:"cloud-provider"`
-						FlexVolumePluginDir string `yaml:"flex-volume-plugin-dir"`
-					} `yaml:"extraArgs"`
+					ExtraArgs map[string]string `yaml:"extraArgs"`
 				} `yaml:"controllerManager"`
 				DNS struct {
 				} `yaml:"dns"`
 				Etcd struct {
 					Local struct {
-						ImageTag string `yaml:"imageTag"`
+						ImageTag  string            `yaml:"imageTag"`
+						ExtraArgs map[string]string `yaml:"extraArgs,omitempty"`
 					} `yaml:"local"`
 				} `yaml:"etcd"`
 				Networking struct {
 				} `yaml:"networking"`
 				Scheduler struct {
+					ExtraArgs map[string]string `yaml:"extraArgs,omitempty"`
 				} `yaml:"scheduler"`
 			} `yaml:"clusterConfiguration"`
-			Files []struct {
-				Content     string `yaml:"content,omitempty"`
-				Path        string `yaml:"path"`
-				Permissions string `yaml:"permissions"`
-				ContentFrom struct {
-					Secret struct {
-						Key  string `yaml:"key"`
-						Name string `yaml:"name"`
-					} `yaml:"secret"`
-				} `yaml:"contentFrom,omitempty"`
-				Owner string `yaml:"owner,omitempty"`
-			} `yaml:"files"`
-			Format            string `yaml:"format"`
+			Files             []KubeadmFile `yaml:"files"`
+			Format            string        `yaml:"format"`
 			InitConfiguration struct {
 				LocalAPIEndpoint struct {
 				} `yaml:"localAPIEndpoint"`
 				NodeRegistration struct {
-					CriSocket        string `yaml:"criSocket"`
-					KubeletExtraArgs struct {
-						CloudProvider   string `yaml:"cloud-provider"`
-						ProviderID      string `yaml:"provider-id"`
-						VolumePluginDir string `yaml:"volume-plugin-dir"`
-					} `yaml:"kubeletExtraArgs"`
+					CriSocket        string            `yaml:"criSocket"`
+					KubeletExtraArgs map[string]string `yaml:"kubeletExtraArgs"`
+					Taints           []Taint           `yaml:"taints,omitempty"`
 				} `yaml:"nodeRegistration"`
 			} `yaml:"initConfiguration"`
 			JoinConfiguration struct {
 				Discovery struct {
 				} `yaml:"discovery"`
 				NodeRegistration struct {
-					CriSocket        string `yaml:"criSocket"`
-					KubeletExtraArgs struct {
-						CloudProvider   string `yaml:"cloud-provider"`
-						ProviderID      string `yaml:"provider-id"`
-						VolumePluginDir string `yaml:"volume-plugin-dir"`
-					} `yaml:"kubeletExtraArgs"`
+					CriSocket        string            `yaml:"criSocket"`
+					KubeletExtraArgs map[string]string `yaml:"kubeletExtraArgs"`
+					Taints           []Taint           `yaml:"taints,omitempty"`
 				} `yaml:"nodeRegistration"`
 			} `yaml:"joinConfiguration"`
-			PreKubeadmCommands []string `yaml:"preKubeadmCommands"`
+			PreKubeadmCommands  []string `yaml:"preKubeadmCommands"`
+			PostKubeadmCommands []string `yaml:"postKubeadmCommands,omitempty"`
 		} `yaml:"kubeadmConfigSpec"`
 		MachineTemplate struct {
 			InfrastructureRef struct {
@@ -144,6 +281,7 @@ type KubeadmControlPlane struct {
 				Namespace  string `yaml:"namespace"`
 			} `yaml:"infrastructureRef"`
 			Metadata struct {
+				Labels map[string]string `yaml:"labels,omitempty"`
 			} `yaml:"metadata"`
 		} `yaml:"machineTemplate"`
 		Replicas        int `yaml:"replicas"`
@@ -214,6 +352,8 @@ type MachineDeployment struct {
 				Labels struct {
 					ClusterXK8SIoClusterName    string `yaml:"cluster.x-k8s.io/cluster-name"`
 					ClusterXK8SIoDeploymentName string `yaml:"cluster.x-k8s.io/deployment-name"`
+					//node pool labels from cluster.yaml
+					Pool map[string]string `yaml:",inline"`
 				} `yaml:"labels"`
 			} `yaml:"metadata"`
 			Spec struct {
@@ -246,20 +386,13 @@ type KubeadmConfigTemplate struct {
 	Spec struct {
 		Template struct {
 			Spec struct {
-				Files []struct {
-					Content     string `yaml:"content"`
-					Path        string `yaml:"path"`
-					Permissions string `yaml:"permissions"`
-				} `yaml:"files"`
-				Format            string `yaml:"format"`
+				Files             []KubeadmFile `yaml:"files"`
+				Format            string        `yaml:"format"`
 				JoinConfiguration struct {
 					NodeRegistration struct {
-						CriSocket        string `yaml:"criSocket"`
-						KubeletExtraArgs struct {
-							CloudProvider   string `yaml:"cloud-provider"`
-							ProviderID      string `yaml:"provider-id"`
-							VolumePluginDir string `yaml:"volume-plugin-dir"`
-						} `yaml:"kubeletExtraArgs"`
+						CriSocket        string            `yaml:"criSocket"`
+						KubeletExtraArgs map[string]string `yaml:"kubeletExtraArgs"`
+						Taints           []Taint           `yaml:"taints,omitempty"`
 					} `yaml:"nodeRegistration"`
 				} `yaml:"joinConfiguration"`
 				PreKubeadmCommands  []string `yaml:"preKubeadmCommands"`
@@ -324,6 +457,40 @@ type capiCluster struct {
 	} `yaml:"spec"`
 }
 
+type encryptionConfiguration struct {
+	APIVersion string               `yaml:"apiVersion"`
+	Kind       string               `yaml:"kind"`
+	Resources  []encryptionResource `yaml:"resources"`
+}
+
+type encryptionResource struct {
+	Resources []string                 `yaml:"resources"`
+	Providers []map[string]interface{} `yaml:"providers"`
+}
+
+// progress of pkd up, stored in .pkd/state.yaml so a failed deploy can be resumed
+type upState struct {
+	Cluster string       `yaml:"cluster"`
+	Phases  []phaseState `yaml:"phases"`
+}
+
+type phaseState struct {
+	Name      string `yaml:"name"`
+	Completed string `yaml:"completed"`
+}
+
+type k8sSecret struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string            `yaml:"name"`
+		Namespace string            `yaml:"namespace"`
+		Labels    map[string]string `yaml:"labels,omitempty"`
+	} `yaml:"metadata"`
+	Type string            `yaml:"type"`
+	Data map[string]string `yaml:"data"`
+}
+
 // this class is used to read in a generic k8s object from the dry run output. We don't know what it will be until we look
 type k8sObject struct {
 	APIVersion string                 `yaml:"apiVersion,omitempty"`
@@ -337,19 +504,14 @@ type kibOverride struct {
 	Gpu struct {
 		Types []string `yaml:"types,omitempty"`
 	} `yaml:"gpu,omitempty"`
-	BuildNameExtra              string `yaml:"build_name_extra,omitempty"`
-	DefaultImageRegistryMirrors struct {
-		DockerIo string `yaml:"docker.io,omitempty"`
-		Wildcard string `yaml:"*,omitempty"`
-	} `yaml:"default_image_registry_mirrors,omitempty"`
-	ImageRegistriesWithAuth []struct {
-		Host          string `yaml:"host,omitempty"`
-		Username      string `yaml:"username,omitempty"`
-		Password      string `yaml:"password,omitempty"`
-		Auth          string `yaml:"auth,omitempty"`
-		IdentityToken string `yaml:"identityToken,omitempty"`
-	} `yaml:"image_registries_with_auth,omitempty"`
-	OsPackagesLocalBundleFile  string `yaml:"os_packages_local_bundle_file,omitempty"`
-	PipPackagesLocalBundleFile string `yaml:"pip_packages_local_bundle_file,omitempty"`
-	ImagesLocalBundleDir       string `yaml:"images_local_bundle_dir,omitempty"`
+	BuildNameExtra string `yaml:"build_name_extra,omitempty"`
+	//mirrored registry, ie docker.io or *, to the registry URL images are pulled from instead
+	DefaultImageRegistryMirrors map[string]string `yaml:"default_image_registry_mirrors,omitempty"`
+	ImageRegistriesWithAuth     []kibRegistry     `yaml:"image_registries_with_auth,omitempty"`
+	OsPackagesLocalBundleFile   string            `yaml:"os_packages_local_bundle_file,omitempty"`
+	PipPackagesLocalBundleFile  string            `yaml:"pip_packages_local_bundle_file,omitempty"`
+	ImagesLocalBundleDir        string            `yaml:"images_local_bundle_dir,omitempty"`
+	HTTPProxy                   string            `yaml:"http_proxy,omitempty"`
+	HTTPSProxy                  string            `yaml:"https_proxy,omitempty"`
+	NoProxy                     string            `yaml:"no_proxy,omitempty"`
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// an external program pkd runs, ie ./dkp, docker or ./konvoy-image
+type command struct {
+	Name string
+	Args []string
+	//working directory, empty for the current directory
+	Dir string
+	//written to the command's standard input, ie a credential helper request
+	Stdin []byte
+}
+
+func newCommand(name string, args ...string) command {
+	return command{Name: name, Args: args}
+}
+
+// the command line with registered secrets masked, safe to print or log
+func (c command) String() string {
+	return redact(strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " ")))
+}
+
+// Everything pkd shells out to goes through a commandRunner so the orchestration can be run
+// against recorded responses instead of real dkp, docker and konvoy-image binaries
+type commandRunner interface {
+	// stdout and stderr interleaved, the way they are shown to the user
+	CombinedOutput(cmd command) ([]byte, error)
+	// stdout and stderr kept apart, for commands whose stdout is a file we write out
+	Output(cmd command) ([]byte, []byte, error)
+}
+
+var runner commandRunner = execRunner{}
+
+type execRunner struct{}
+
+func (execRunner) CombinedOutput(cmd command) ([]byte, error) {
+	return execCommand(cmd).CombinedOutput()
+}
+
+func (execRunner) Output(cmd command) ([]byte, []byte, error) {
+	c := execCommand(cmd)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+func execCommand(cmd command) *exec.Cmd {
+	c := exec.Command(cmd.Name, cmd.Args...)
+	c.Dir = cmd.Dir
+	if cmd.Stdin != nil {
+		c.Stdin = bytes.NewReader(cmd.Stdin)
+	}
+	return c
+}
+
+// run a command, print everything it wrote and exit if it fails
+func run(cmd command) []byte {
+	output, err := runner.CombinedOutput(cmd)
+	printOutput(output)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return output
+}
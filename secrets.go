@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ${env:REGISTRY_PASSWORD}
+var envReference = regexp.MustCompile(`^\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+// Resolve a cluster.yaml value that refers to a secret kept elsewhere, either an environment
+// variable, ${env:NAME}, or a file, file:/run/secrets/name. Anything else is used as it is
+func resolveSecret(value string) (string, error) {
+
+	if match := envReference.FindStringSubmatch(value); match != nil {
+		resolved, ok := os.LookupEnv(match[1])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", match[1])
+		}
+		return resolved, nil
+	}
+	if strings.HasPrefix(value, "${") {
+		return "", fmt.Errorf("%q is not a valid reference, use ${env:NAME}", value)
+	}
+	if strings.HasPrefix(value, "file:") {
+		data, err := os.ReadFile(expandHome(strings.TrimPrefix(value, "file:")))
+		if err != nil {
+			return "", err
+		}
+		//files written with echo or an editor end in a newline that isn't part of the secret
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// Resolve a cluster.yaml field that holds a path, ie sshprivatekey. ${env:NAME} is a variable
+// holding the path and file: only marks the value as a path, the file itself is not read
+func resolvePath(value string) (string, error) {
+
+	if strings.HasPrefix(value, "file:") {
+		return expandHome(strings.TrimPrefix(value, "file:")), nil
+	}
+	resolved, err := resolveSecret(value)
+	if err != nil {
+		return "", err
+	}
+	return expandHome(resolved), nil
+}
+
+// ~/.docker/config.json
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// Replace every secret reference in cluster.yaml with its value. Called by loadCluster so
+// nothing else in pkd ever sees a reference, errors name the field at fault but never a value
+func resolveClusterSecrets(cluster *pkdCluster) error {
+
+	resolve := func(path string, value *string) error {
+		resolved, err := resolveSecret(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		*value = resolved
+		return nil
+	}
+	//ssh keys are passed to dkp, KIB and the ssh secrets by path
+	resolveKeyPath := func(path string, value *string) error {
+		resolved, err := resolvePath(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		*value = resolved
+		return nil
+	}
+	resolveRegistry := func(path string, registry *Registry) error {
+		if err := resolve(path+".username", &registry.Username); err != nil {
+			return err
+		}
+		if err := resolve(path+".password", &registry.Password); err != nil {
+			return err
+		}
+		if registry.DockerConfig == "" || registry.Username != "" || registry.Password != "" {
+			return nil
+		}
+		var err error
+		registry.Username, registry.Password, err = dockerCredentials(registry.DockerConfig, registry.Host)
+		if err != nil {
+			return fmt.Errorf("%s.dockerconfig: %v", path, err)
+		}
+		return nil
+	}
+
+	if err := resolveKeyPath("metadata.sshprivatekey", &cluster.MetaData.SshPrivateKey); err != nil {
+		return err
+	}
+	if err := resolve("proxy.httpproxy", &cluster.Proxy.HTTPProxy); err != nil {
+		return err
+	}
+	if err := resolve("proxy.httpsproxy", &cluster.Proxy.HTTPSProxy); err != nil {
+		return err
+	}
+	if err := resolveRegistry("registry", &cluster.Registry); err != nil {
+		return err
+	}
+	for i := range cluster.Registries {
+		if err := resolveRegistry(fmt.Sprintf("registries[%d]", i), &cluster.Registries[i]); err != nil {
+			return err
+		}
+	}
+	resolvePool := func(prefix string, pool NodePool) error {
+		for _, name := range sortedHostNames(pool.Hosts) {
+			host := pool.Hosts[name]
+			if err := resolveKeyPath(prefix+".hosts."+name+".sshprivatekey", &host.SshPrivateKey); err != nil {
+				return err
+			}
+			pool.Hosts[name] = host
+		}
+		return nil
+	}
+	if err := resolvePool("controlplane", cluster.Controlplane); err != nil {
+		return err
+	}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		if err := resolvePool("nodepools."+poolName, cluster.NodePools[poolName]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the parts of a docker config.json that hold credentials
+type dockerConfigFile struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+type dockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// docker login stores docker hub as https://index.docker.io/v1/, everything else by host
+func dockerConfigHost(key string) string {
+
+	endpoint, err := parseRegistry(key)
+	if err != nil {
+		return key
+	}
+	switch endpoint.Host {
+	case "index.docker.io", "registry-1.docker.io", "docker.io":
+		return "docker.io"
+	}
+	return endpoint.Host
+}
+
+// Look up the credentials docker login stored for a registry, either in the config itself
+// or in the credential helper it names for the registry
+func dockerCredentials(configPath string, registryHost string) (string, string, error) {
+
+	data, err := os.ReadFile(expandHome(configPath))
+	if err != nil {
+		return "", "", err
+	}
+	config := dockerConfigFile{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return "", "", fmt.Errorf("%s is not a docker config.json: %v", configPath, err)
+	}
+	host := dockerConfigHost(registryHost)
+
+	for _, key := range sortedKeys(config.CredHelpers) {
+		if dockerConfigHost(key) == host {
+			return credentialHelper(config.CredHelpers[key], key)
+		}
+	}
+	for _, key := range sortedAuthKeys(config.Auths) {
+		auth := config.Auths[key]
+		if dockerConfigHost(key) != host {
+			continue
+		}
+		if auth.Auth == "" {
+			if auth.Username != "" {
+				return auth.Username, auth.Password, nil
+			}
+			//docker login with a credsStore leaves an empty entry behind
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("the auth stored for %s is not base64", key)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("the auth stored for %s is not username:password", key)
+		}
+		return parts[0], parts[1], nil
+	}
+	if config.CredsStore != "" {
+		serverURL := registryHost
+		if host == "docker.io" {
+			serverURL = "https://index.docker.io/v1/"
+		}
+		return credentialHelper(config.CredsStore, serverURL)
+	}
+	return "", "", fmt.Errorf("no credentials for %s in %s", host, configPath)
+}
+
+// docker-credential-<helper> get reads the server URL on stdin and answers with json
+func credentialHelper(helper string, serverURL string) (string, string, error) {
+
+	cmd := newCommand("docker-credential-"+helper, "get")
+	cmd.Stdin = []byte(serverURL)
+	stdout, _, err := runner.Output(cmd)
+	if err != nil {
+		//helpers print the reason on stdout, ie credentials not found in native keychain
+		reason := strings.TrimSpace(string(stdout))
+		if reason == "" {
+			reason = err.Error()
+		}
+		return "", "", fmt.Errorf("docker-credential-%s: %s", helper, reason)
+	}
+	credentials := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	err = json.Unmarshal(stdout, &credentials)
+	if err != nil {
+		return "", "", errors.New("docker-credential-" + helper + " did not answer with credentials")
+	}
+	return credentials.Username, credentials.Secret, nil
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// cluster names end up in every object name, so they must be valid RFC 1123 labels
+var clusterNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// flag names as kubeadm passes them on, ie max-pods
+var argNameRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// kubeadm file permissions are octal, ie 0644
+var filePermissionsRegex = regexp.MustCompile(`^0?[0-7]{3}$`)
+
+// Check cluster.yaml for every problem we can find before anything is deployed.
+// Each problem is reported as "<field path>: <message>"
+func validateCluster(cluster pkdCluster) []string {
+
+	problems := []string{}
+	report := func(path string, format string, args ...interface{}) {
+		problems = append(problems, path+": "+fmt.Sprintf(format, args...))
+	}
+	checkLabels := func(path string, labels map[string]string) {
+		for _, key := range sortedKeys(labels) {
+			for _, msg := range validation.IsQualifiedName(key) {
+				report(path, "%q is not a valid label key: %s", key, msg)
+			}
+			//CAPI sets these itself, ie the MachineDeployment's cluster-name and deployment-name
+			if strings.HasPrefix(key, "cluster.x-k8s.io/") {
+				report(path, "%q is in the cluster.x-k8s.io namespace reserved for Cluster API", key)
+			}
+			for _, msg := range validation.IsValidLabelValue(labels[key]) {
+				report(path+"."+key, "%q is not a valid label value: %s", labels[key], msg)
+			}
+		}
+	}
+
+	//required metadata
+	required := map[string]string{
+		"metadata.dkpversion":        cluster.MetaData.DKPversion,
+		"metadata.name":              cluster.MetaData.Name,
+		"metadata.sshuser":           cluster.MetaData.SshUser,
+		"metadata.sshprivatekey":     cluster.MetaData.SshPrivateKey,
+		"metadata.metaladdressrange": cluster.MetaData.MetalAddressRange,
+	}
+	//kube-vip only needs an address and interface when it serves the endpoint
+	if cluster.ControlPlaneEndpoint.External {
+		required["controlplaneendpoint.host"] = cluster.ControlPlaneEndpoint.Host
+	} else {
+		required["metadata.interfacename"] = cluster.MetaData.InterfaceName
+		required["metadata.kubeviploadbalancer"] = cluster.MetaData.KubeVipLoadbalancer
+	}
+	for _, path := range sortedKeys(required) {
+		if strings.TrimSpace(required[path]) == "" {
+			report(path, "is required")
+		}
+	}
+	if cluster.MetaData.Name != "" && (len(cluster.MetaData.Name) > 63 || !clusterNameRegex.MatchString(cluster.MetaData.Name)) {
+		report("metadata.name", "%q must be lowercase alphanumeric characters or '-', start and end with an alphanumeric character and be at most 63 characters", cluster.MetaData.Name)
+	}
+	if cluster.MetaData.SshPrivateKey != "" {
+		if stat, err := os.Stat(cluster.MetaData.SshPrivateKey); err != nil {
+			report("metadata.sshprivatekey", "cannot read ssh key %q: %v", cluster.MetaData.SshPrivateKey, err)
+		} else if stat.IsDir() {
+			report("metadata.sshprivatekey", "%q is a directory, not an ssh key", cluster.MetaData.SshPrivateKey)
+		}
+	}
+	if cluster.MetaData.EncryptionKeyFile != "" {
+		if _, err := loadEncryptionConfig(cluster.MetaData.EncryptionKeyFile); err != nil {
+			report("metadata.encryptionkeyfile", "%v", err)
+		}
+	}
+	timeouts := map[string]string{
+		"metadata.kibtimeout":   cluster.MetaData.KIBTimeout,
+		"metadata.pivottimeout": cluster.MetaData.PivotTimeout,
+	}
+	for _, path := range sortedKeys(timeouts) {
+		timeout := timeouts[path]
+		if timeout == "" {
+			continue
+		}
+		if minutes, err := strconv.Atoi(timeout); err != nil || minutes <= 0 {
+			report(path, "%q must be a whole number of minutes", timeout)
+		}
+	}
+
+	//every generated CAPI object and air gap artifact uses these versions
+	cpVersion := poolK8sVersion(cluster, cluster.Controlplane)
+	if err := supportedK8sVersion(cluster.MetaData.DKPversion, cluster.MetaData.K8sVersion); err != nil {
+		report("metadata.k8sversion", "%v", err)
+	}
+	//the KIB overrides and seeded hosts use the os packages bundle for this os and version
+	if cluster.AirGap.Enabled {
+		if cluster.AirGap.OsVersion == "" {
+			report("airgap.osversion", "is required when air gap is enabled")
+		}
+		if cluster.AirGap.ContainerdVersion == "" {
+			report("airgap.containerdversion", "is required when air gap is enabled")
+		}
+		//the seed phase copies every key into the kib directory under its base name
+		keyNames := map[string]string{}
+		for _, key := range sshPrivateKeys(cluster) {
+			if other, ok := keyNames[filepath.Base(key)]; ok {
+				report("airgap", "ssh keys %q and %q have the same file name and would overwrite each other in the kib directory", other, key)
+				continue
+			}
+			keyNames[filepath.Base(key)] = key
+		}
+	}
+	if cluster.AirGap.K8sVersion != "" && artifactK8sVersion(cluster.AirGap.K8sVersion) != artifactK8sVersion(cluster.MetaData.K8sVersion) {
+		report("airgap.k8sversion", "%s does not match metadata.k8sversion %s, remove it or set them to the same version", cluster.AirGap.K8sVersion, cluster.MetaData.K8sVersion)
+	}
+	checkPoolVersion := func(path string, pool NodePool) {
+		if pool.K8sVersion == "" {
+			return
+		}
+		if err := supportedK8sVersion(cluster.MetaData.DKPversion, pool.K8sVersion); err != nil {
+			report(path, "%v", err)
+			return
+		}
+		if cluster.AirGap.Enabled && normalizeK8sVersion(pool.K8sVersion) != cluster.MetaData.K8sVersion {
+			report(path, "air gapped hosts are only seeded with packages for metadata.k8sversion %s", cluster.MetaData.K8sVersion)
+		}
+		//kubelets must never be newer than the api server
+		_, poolMinor, _ := parseK8sVersion(pool.K8sVersion)
+		_, cpMinor, err := parseK8sVersion(cpVersion)
+		if err == nil && poolMinor > cpMinor {
+			report(path, "%s is newer than the control plane version %s", normalizeK8sVersion(pool.K8sVersion), cpVersion)
+		}
+	}
+	checkPoolVersion("controlplane.k8sversion", cluster.Controlplane)
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		checkPoolVersion("nodepools."+poolName+".k8sversion", cluster.NodePools[poolName])
+	}
+
+	//control plane must be able to keep etcd quorum
+	cpCount := len(cluster.Controlplane.Hosts)
+	if cpCount == 0 {
+		report("controlplane.hosts", "at least one control plane host is required")
+	} else if cpCount%2 == 0 {
+		report("controlplane.hosts", "%d control plane hosts configured, an odd number is required to maintain etcd quorum", cpCount)
+	}
+
+	if initHost := cluster.Controlplane.InitHost; initHost != "" {
+		if _, ok := cluster.Controlplane.Hosts[initHost]; !ok {
+			report("controlplane.inithost", "%q is not one of the control plane hosts", initHost)
+		}
+	}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		if cluster.NodePools[poolName].InitHost != "" {
+			report("nodepools."+poolName+".inithost", "only the control plane has an init host")
+		}
+	}
+
+	//pool labels and taints are set by the kubelet when it registers the node
+	checkPoolScheduling := func(prefix string, pool NodePool) {
+		checkLabels(prefix+".labels", pool.Labels)
+		for _, key := range sortedKeys(pool.Labels) {
+			if !kubeletLabelAllowed(key) {
+				report(prefix+".labels", "%q is in a kubernetes.io or k8s.io namespace the kubelet is not allowed to set", key)
+			}
+		}
+		for i, taint := range pool.Taints {
+			path := fmt.Sprintf("%s.taints[%d]", prefix, i)
+			for _, msg := range validation.IsQualifiedName(taint.Key) {
+				report(path+".key", "%q is not a valid taint key: %s", taint.Key, msg)
+			}
+			for _, msg := range validation.IsValidLabelValue(taint.Value) {
+				report(path+".value", "%q is not a valid taint value: %s", taint.Value, msg)
+			}
+			if taint.Effect != "NoSchedule" && taint.Effect != "PreferNoSchedule" && taint.Effect != "NoExecute" {
+				report(path+".effect", "%q must be one of NoSchedule, PreferNoSchedule or NoExecute", taint.Effect)
+			}
+		}
+	}
+	//each extra file needs somewhere to go and exactly one source for its content
+	checkPoolFiles := func(prefix string, pool NodePool) {
+		paths := map[string]bool{}
+		for i, file := range pool.Files {
+			path := fmt.Sprintf("%s.files[%d]", prefix, i)
+			if !strings.HasPrefix(file.Path, "/") {
+				report(path+".path", "%q must be an absolute path", file.Path)
+			} else if paths[file.Path] {
+				report(path+".path", "%s is already written by another file in the pool", file.Path)
+			}
+			paths[file.Path] = true
+			if reserved := reservedFilePath(cluster, file.Path); reserved != "" {
+				report(path+".path", "%s is written by pkd itself (%s)", file.Path, reserved)
+			}
+			if file.Permissions != "" && !filePermissionsRegex.MatchString(file.Permissions) {
+				report(path+".permissions", "%q must be octal, ie 0644", file.Permissions)
+			}
+			sources := 0
+			if file.Content != "" {
+				sources++
+			}
+			if file.File != "" {
+				sources++
+				if info, err := os.Stat(file.File); err != nil {
+					report(path+".file", "cannot read %q: %v", file.File, err)
+				} else if info.IsDir() {
+					report(path+".file", "%q is a directory", file.File)
+				}
+			}
+			if file.Secret != nil {
+				sources++
+				if file.Secret.Name == "" || file.Secret.Key == "" {
+					report(path+".secret", "name and key are required")
+				}
+			}
+			if sources != 1 {
+				report(path, "exactly one of content, file or secret must be set")
+			}
+		}
+	}
+	checkArgs := func(path string, args map[string]string) {
+		for _, key := range sortedKeys(args) {
+			if !argNameRegex.MatchString(argName(key)) {
+				report(path, "%q is not a valid flag name", key)
+			}
+		}
+	}
+	//the endpoint and extra SANs end up in the api server certificate
+	endpoint := cluster.ControlPlaneEndpoint
+	if endpoint.Host != "" && net.ParseIP(endpoint.Host) == nil {
+		for _, msg := range validation.IsDNS1123Subdomain(endpoint.Host) {
+			report("controlplaneendpoint.host", "%q is neither an IP address nor a DNS name: %s", endpoint.Host, msg)
+		}
+	}
+	if endpoint.Port < 1 || endpoint.Port > 65535 {
+		report("controlplaneendpoint.port", "%d is not a valid port", endpoint.Port)
+	} else if !endpoint.External && endpoint.Port != 6443 {
+		report("controlplaneendpoint.port", "kube-vip serves the api server on 6443, another port needs an external load balancer")
+	}
+	if endpoint.External && cluster.MetaData.KubeVipLoadbalancer != "" {
+		report("metadata.kubeviploadbalancer", "must not be set with an external control plane endpoint, kube-vip is not deployed")
+	}
+	for i, san := range endpoint.CertSANs {
+		if net.ParseIP(san) != nil {
+			continue
+		}
+		if len(validation.IsDNS1123Subdomain(san)) > 0 && len(validation.IsWildcardDNS1123Subdomain(san)) > 0 {
+			report(fmt.Sprintf("controlplaneendpoint.certsans[%d]", i), "%q is neither an IP address nor a DNS name", san)
+		}
+	}
+
+	//containerd refuses to pull from a registry whose CA or client certificate it can't load,
+	//and each registry can only be mirrored by one other
+	mirroredBy := map[string]string{}
+	checkRegistry := func(path string, registry Registry) {
+		if registry.Host != "" {
+			if _, err := parseRegistry(registry.Host); err != nil {
+				report(path+".host", "%v", err)
+			}
+		}
+		if registry.CAFile != "" {
+			if data, err := os.ReadFile(registry.CAFile); err != nil {
+				report(path+".cafile", "cannot read %q: %v", registry.CAFile, err)
+			} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+				report(path+".cafile", "%q contains no PEM encoded certificates", registry.CAFile)
+			}
+		}
+		if (registry.CertFile == "") != (registry.KeyFile == "") {
+			report(path, "certfile and keyfile must be set together")
+		} else if registry.CertFile != "" {
+			if _, err := tls.LoadX509KeyPair(registry.CertFile, registry.KeyFile); err != nil {
+				report(path+".certfile", "%v", err)
+			}
+		}
+		for i, mirrored := range registry.Mirrors {
+			if other, ok := mirroredBy[mirrored]; ok {
+				report(fmt.Sprintf("%s.mirrors[%d]", path, i), "%s is already mirrored by %s", mirrored, other)
+			}
+			mirroredBy[mirrored] = path
+		}
+	}
+	if cluster.Registry.Host == "" && (registryTLSEnabled(cluster.Registry) || len(cluster.Registry.Mirrors) > 0) {
+		report("registry.host", "is required")
+	}
+	checkRegistry("registry", primaryRegistry(cluster))
+	for i, registry := range cluster.Registries {
+		path := fmt.Sprintf("registries[%d]", i)
+		if registry.Host == "" {
+			report(path+".host", "is required")
+		}
+		checkRegistry(path, registry)
+	}
+	//a registry with TLS settings writes hosts.toml for itself and for every registry it mirrors
+	certsDirs := map[string]string{}
+	for _, registry := range clusterRegistries(cluster) {
+		endpoint, err := parseRegistry(registry.Host)
+		if err != nil || !registryTLSEnabled(registry) {
+			continue
+		}
+		dirs := []string{registryCertsDir(endpoint)}
+		for _, mirrored := range registry.Mirrors {
+			if mirrorCertsDir(mirrored) != registryCertsDir(endpoint) {
+				dirs = append(dirs, mirrorCertsDir(mirrored))
+			}
+		}
+		for _, dir := range dirs {
+			if other, ok := certsDirs[dir]; ok && other != registry.Host {
+				report("registries", "%s and %s would both write %s/hosts.toml", other, registry.Host, dir)
+				continue
+			}
+			certsDirs[dir] = registry.Host
+		}
+	}
+
+	//proxies are written into systemd units and KIB's environment as they are
+	checkProxy := func(path string, value string) {
+		if value == "" {
+			return
+		}
+		if proxy, err := url.Parse(value); err != nil || (proxy.Scheme != "http" && proxy.Scheme != "https") || proxy.Host == "" {
+			report(path, "%q must be an http or https URL, ie http://proxy.example.com:3128", value)
+		}
+	}
+	checkProxy("proxy.httpproxy", cluster.Proxy.HTTPProxy)
+	checkProxy("proxy.httpsproxy", cluster.Proxy.HTTPSProxy)
+	for i, entry := range cluster.Proxy.NoProxy {
+		if strings.TrimSpace(entry) == "" || strings.ContainsAny(entry, ", \"\n") {
+			report(fmt.Sprintf("proxy.noproxy[%d]", i), "%q must be a single host, domain, IP or CIDR", entry)
+		}
+	}
+	if len(cluster.Proxy.NoProxy) > 0 && !proxyEnabled(cluster.Proxy) {
+		report("proxy.noproxy", "has no effect without proxy.httpproxy or proxy.httpsproxy")
+	}
+
+	//a bad audit policy or webhook config keeps the api server from starting
+	audit := cluster.Audit
+	if audit.PolicyFile != "" {
+		data, err := os.ReadFile(audit.PolicyFile)
+		if err != nil {
+			report("audit.policyfile", "cannot read %q: %v", audit.PolicyFile, err)
+		} else {
+			for _, problem := range checkAuditPolicy(data) {
+				report("audit.policyfile", "%s", problem)
+			}
+		}
+	}
+	checkRetention := func(path string, value *int) {
+		if value != nil && *value < 0 {
+			report(path, "%d cannot be negative", *value)
+		}
+	}
+	checkRetention("audit.maxage", audit.MaxAge)
+	checkRetention("audit.maxbackup", audit.MaxBackup)
+	checkRetention("audit.maxsize", audit.MaxSize)
+	if audit.WebhookConfigFile != "" {
+		data, err := os.ReadFile(audit.WebhookConfigFile)
+		if err != nil {
+			report("audit.webhookconfigfile", "cannot read %q: %v", audit.WebhookConfigFile, err)
+		} else if err := checkAuditWebhookConfig(data); err != nil {
+			report("audit.webhookconfigfile", "%q is not a valid kubeconfig: %v", audit.WebhookConfigFile, err)
+		}
+	}
+	if audit.WebhookMode != "" {
+		if audit.WebhookConfigFile == "" {
+			report("audit.webhookmode", "requires audit.webhookconfigfile")
+		} else if audit.WebhookMode != "batch" && audit.WebhookMode != "blocking" && audit.WebhookMode != "blocking-strict" {
+			report("audit.webhookmode", "%q must be one of batch, blocking or blocking-strict", audit.WebhookMode)
+		}
+	}
+
+	//the api server refuses to start with a half configured or non https issuer
+	oidc := cluster.OIDC
+	if oidc.IssuerURL != "" {
+		if issuer, err := url.Parse(oidc.IssuerURL); err != nil || issuer.Scheme != "https" || issuer.Host == "" {
+			report("oidc.issuerurl", "%q must be an https URL", oidc.IssuerURL)
+		}
+		if oidc.ClientID == "" {
+			report("oidc.clientid", "is required")
+		}
+		if oidc.CAFile != "" {
+			if info, err := os.Stat(oidc.CAFile); err != nil {
+				report("oidc.cafile", "cannot read %q: %v", oidc.CAFile, err)
+			} else if info.IsDir() {
+				report("oidc.cafile", "%q is a directory", oidc.CAFile)
+			}
+		}
+	} else if oidc != (OIDC{}) {
+		report("oidc.issuerurl", "is required")
+	}
+	checkArgs("extraargs.apiserver", cluster.ExtraArgs.APIServer)
+	checkArgs("extraargs.controllermanager", cluster.ExtraArgs.ControllerManager)
+	checkArgs("extraargs.scheduler", cluster.ExtraArgs.Scheduler)
+	checkArgs("extraargs.etcd", cluster.ExtraArgs.Etcd)
+
+	//the provider id ties a node to its machine and node labels have a section of their own
+	checkKubeletArgs := func(prefix string, pool NodePool) {
+		checkArgs(prefix+".kubeletextraargs", pool.KubeletExtraArgs)
+		for _, key := range sortedKeys(pool.KubeletExtraArgs) {
+			switch argName(key) {
+			case "provider-id":
+				report(prefix+".kubeletextraargs", "provider-id is set by the preprovisioned provider and cannot be changed")
+			case "node-labels":
+				report(prefix+".kubeletextraargs", "set node labels in %s.labels instead", prefix)
+			}
+		}
+	}
+	checkPoolScheduling("controlplane", cluster.Controlplane)
+	checkPoolFiles("controlplane", cluster.Controlplane)
+	checkKubeletArgs("controlplane", cluster.Controlplane)
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		checkPoolScheduling("nodepools."+poolName, cluster.NodePools[poolName])
+		checkPoolFiles("nodepools."+poolName, cluster.NodePools[poolName])
+		checkKubeletArgs("nodepools."+poolName, cluster.NodePools[poolName])
+	}
+
+	//every host must have a valid and unique ip
+	hostIPs := map[string]string{}
+	checkHosts := func(prefix string, pool NodePool) {
+		for _, name := range sortedHostNames(pool.Hosts) {
+			path := prefix + ".hosts." + name
+			host := pool.Hosts[name]
+			if host.Port < 0 || host.Port > 65535 {
+				report(path+".port", "%d is not a valid port", host.Port)
+			}
+			if host.SshPrivateKey != "" {
+				if stat, err := os.Stat(host.SshPrivateKey); err != nil {
+					report(path+".sshprivatekey", "cannot read ssh key %q: %v", host.SshPrivateKey, err)
+				} else if stat.IsDir() {
+					report(path+".sshprivatekey", "%q is a directory, not an ssh key", host.SshPrivateKey)
+				}
+			}
+			checkLabels(path+".labels", host.Labels)
+			for _, key := range sortedKeys(host.Labels) {
+				if !kubeletLabelAllowed(key) {
+					report(path+".labels", "%q is in a kubernetes.io or k8s.io namespace the kubelet is not allowed to set", key)
+				}
+			}
+			//node pools split into nodesets, the control plane is a single PreprovisionedInventory and KubeadmControlPlane
+			if prefix == "controlplane" {
+				if ssh, first := hostSSH(cluster.MetaData, host), poolSSH(cluster.MetaData, pool); ssh != first {
+					report(path, "ssh settings must match the other control plane hosts: user %s, port %d, key %s", first.User, first.Port, first.PrivateKey)
+				}
+				if len(host.Labels) > 0 {
+					report(path+".labels", "control plane hosts can't have labels of their own, set controlplane.labels instead")
+				}
+			}
+			ip := net.ParseIP(host.Address)
+			if ip == nil {
+				report(path, "%q is not a valid IP address", host.Address)
+				continue
+			}
+			if other, ok := hostIPs[ip.String()]; ok {
+				report(path, "%s is already used by %s", ip, other)
+				continue
+			}
+			hostIPs[ip.String()] = path
+		}
+	}
+	checkHosts("controlplane", cluster.Controlplane)
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		if len(cluster.NodePools[poolName].Hosts) == 0 {
+			report("nodepools."+poolName+".hosts", "at least one host is required")
+		}
+		checkHosts("nodepools."+poolName, cluster.NodePools[poolName])
+	}
+
+	//the extra nodesets of a pool must not take the name of another pool or nodeset
+	nodesetPools := map[string]string{"control-plane": "controlplane"}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		if other, ok := nodesetPools[poolName]; ok {
+			report("nodepools."+poolName, "is already used as a nodeset name by %s", other)
+		}
+		nodesetPools[poolName] = "nodepools." + poolName
+	}
+	for _, poolName := range sortedPoolNames(cluster.NodePools) {
+		for _, nodesetName := range sortedPoolNames(poolNodesets(cluster.MetaData, poolName, cluster.NodePools[poolName])) {
+			if nodesetName == poolName {
+				continue
+			}
+			if other, ok := nodesetPools[nodesetName]; ok {
+				report("nodepools."+poolName+".hosts", "hosts with their own ssh settings or labels are deployed as nodeset %q, which is already used by %s", nodesetName, other)
+				continue
+			}
+			nodesetPools[nodesetName] = "nodepools." + poolName
+		}
+	}
+
+	//pod and service networks must not overlap each other or the hosts
+	cidrs := map[string]*net.IPNet{}
+	for _, path := range []string{"metadata.podsubnet", "metadata.servicesubnet"} {
+		value := cluster.MetaData.PodSubnet
+		if path == "metadata.servicesubnet" {
+			value = cluster.MetaData.ServiceSubnet
+		}
+		_, cidr, err := net.ParseCIDR(value)
+		if err != nil {
+			report(path, "%q is not a valid CIDR", value)
+			continue
+		}
+		cidrs[path] = cidr
+		for _, ip := range sortedKeys(hostIPs) {
+			if cidr.Contains(net.ParseIP(ip)) {
+				report(path, "%s overlaps %s (%s)", value, hostIPs[ip], ip)
+			}
+		}
+	}
+	if pods, services := cidrs["metadata.podsubnet"], cidrs["metadata.servicesubnet"]; pods != nil && services != nil {
+		if pods.Contains(services.IP) || services.Contains(pods.IP) {
+			report("metadata.servicesubnet", "%s overlaps metadata.podsubnet %s", services, pods)
+		}
+	}
+
+	//addresses handed out by kube-vip and metal-lb must be outside the cluster networks and unused by hosts
+	inClusterNetworks := func(path string, ip net.IP) {
+		for _, cidrPath := range sortedNetKeys(cidrs) {
+			if cidrs[cidrPath].Contains(ip) {
+				report(path, "%s is inside %s %s", ip, cidrPath, cidrs[cidrPath])
+			}
+		}
+		if host, ok := hostIPs[ip.String()]; ok {
+			report(path, "%s is already used by %s", ip, host)
+		}
+	}
+
+	var vip net.IP
+	if cluster.MetaData.KubeVipLoadbalancer != "" {
+		vip = net.ParseIP(cluster.MetaData.KubeVipLoadbalancer)
+		if vip == nil {
+			report("metadata.kubeviploadbalancer", "%q is not a valid IP address", cluster.MetaData.KubeVipLoadbalancer)
+		} else {
+			inClusterNetworks("metadata.kubeviploadbalancer", vip)
+		}
+	}
+
+	if cluster.MetaData.MetalAddressRange != "" {
+		first, last, err := parseAddressRange(cluster.MetaData.MetalAddressRange)
+		if err != nil {
+			report("metadata.metaladdressrange", "%v", err)
+		} else {
+			inClusterNetworks("metadata.metaladdressrange", first)
+			inClusterNetworks("metadata.metaladdressrange", last)
+			for _, cidrPath := range sortedNetKeys(cidrs) {
+				cidr := cidrs[cidrPath]
+				if !cidr.Contains(first) && !cidr.Contains(last) && ipInRange(cidr.IP, first, last) {
+					report("metadata.metaladdressrange", "%s contains %s %s", cluster.MetaData.MetalAddressRange, cidrPath, cidr)
+				}
+			}
+			for _, ip := range sortedKeys(hostIPs) {
+				parsed := net.ParseIP(ip)
+				if !parsed.Equal(first) && !parsed.Equal(last) && ipInRange(parsed, first, last) {
+					report("metadata.metaladdressrange", "%s contains %s (%s)", cluster.MetaData.MetalAddressRange, hostIPs[ip], ip)
+				}
+			}
+			if vip != nil && ipInRange(vip, first, last) {
+				report("metadata.metaladdressrange", "%s contains metadata.kubeviploadbalancer %s", cluster.MetaData.MetalAddressRange, vip)
+			}
+		}
+	}
+
+	return problems
+}
+
+// the NodeRestriction admission plugin only lets a kubelet set its own labels
+// in the kubernetes.io and k8s.io namespaces under these prefixes
+func kubeletLabelAllowed(key string) bool {
+
+	prefix := ""
+	if i := strings.Index(key, "/"); i >= 0 {
+		prefix = key[:i]
+	}
+	restricted := prefix == "kubernetes.io" || strings.HasSuffix(prefix, ".kubernetes.io") || prefix == "k8s.io" || strings.HasSuffix(prefix, ".k8s.io")
+	if !restricted {
+		return true
+	}
+	for _, allowed := range []string{"kubelet.kubernetes.io", "node.kubernetes.io"} {
+		if prefix == allowed || strings.HasSuffix(prefix, "."+allowed) {
+			return true
+		}
+	}
+	switch key {
+	case "kubernetes.io/hostname", "kubernetes.io/arch", "kubernetes.io/os",
+		"topology.kubernetes.io/region", "topology.kubernetes.io/zone":
+		return true
+	}
+	return false
+}
+
+// print every problem and report whether cluster.yaml is usable
+func checkCluster(cluster pkdCluster) bool {
+
+	for _, note := range secretFileNotes(cluster) {
+		fmt.Fprintln(console, "Note: "+note)
+	}
+	problems := validateCluster(cluster)
+	if len(problems) == 0 {
+		return true
+	}
+	fmt.Fprintf(console, "cluster.yaml has %d problem(s):\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintln(console, "  - "+problem)
+	}
+	return false
+}
+
+// metal-lb accepts either a range, ie 10.0.0.20-10.0.0.24, or a CIDR
+func parseAddressRange(addressRange string) (net.IP, net.IP, error) {
+
+	if strings.Contains(addressRange, "/") {
+		_, cidr, err := net.ParseCIDR(addressRange)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q is not a valid CIDR", addressRange)
+		}
+		last := make(net.IP, len(cidr.IP))
+		for i := range cidr.IP {
+			last[i] = cidr.IP[i] | ^cidr.Mask[i]
+		}
+		return cidr.IP, last, nil
+	}
+
+	bounds := strings.Split(addressRange, "-")
+	if len(bounds) != 2 {
+		return nil, nil, fmt.Errorf("%q must be a range of the form <first ip>-<last ip> or a CIDR", addressRange)
+	}
+	first := net.ParseIP(strings.TrimSpace(bounds[0]))
+	last := net.ParseIP(strings.TrimSpace(bounds[1]))
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("%q contains an invalid IP address", addressRange)
+	}
+	if (first.To4() == nil) != (last.To4() == nil) {
+		return nil, nil, fmt.Errorf("%q mixes IPv4 and IPv6 addresses", addressRange)
+	}
+	if bytes.Compare(first.To16(), last.To16()) > 0 {
+		return nil, nil, fmt.Errorf("%q starts after it ends", addressRange)
+	}
+	return first, last, nil
+}
+
+func ipInRange(ip net.IP, first net.IP, last net.IP) bool {
+	return bytes.Compare(ip.To16(), first.To16()) >= 0 && bytes.Compare(ip.To16(), last.To16()) <= 0
+}
+
+// Map keys in order, so checks are reported and files generated in the same order every run.
+// There is one function per map type so a map whose type changes no longer compiles
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedBoolKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHostNames(hosts map[string]Host) []string {
+	names := []string{}
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedPoolNames(pools map[string]NodePool) []string {
+	names := []string{}
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedAuthKeys(m map[string]dockerAuth) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedNetKeys(m map[string]*net.IPNet) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateCluster(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(cluster *pkdCluster)
+		// every one of these must be reported, an empty list means cluster.yaml is valid
+		problems []string
+	}{
+		{
+			name:   "valid",
+			modify: func(cluster *pkdCluster) {},
+		},
+		{
+			name: "required metadata",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.Name = ""
+				cluster.MetaData.SshUser = " "
+				cluster.MetaData.MetalAddressRange = ""
+			},
+			problems: []string{
+				"metadata.metaladdressrange: is required",
+				"metadata.name: is required",
+				"metadata.sshuser: is required",
+			},
+		},
+		{
+			name: "missing ssh key",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.SshPrivateKey = "testdata/missing_rsa"
+			},
+			problems: []string{
+				`metadata.sshprivatekey: cannot read ssh key "testdata/missing_rsa": stat testdata/missing_rsa: no such file or directory`,
+			},
+		},
+		{
+			name: "ssh key is a directory",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.SshPrivateKey = "testdata"
+			},
+			problems: []string{
+				`metadata.sshprivatekey: "testdata" is a directory, not an ssh key`,
+			},
+		},
+		{
+			name: "even control plane count",
+			modify: func(cluster *pkdCluster) {
+				delete(cluster.Controlplane.Hosts, "controlplane3")
+			},
+			problems: []string{
+				"controlplane.hosts: 2 control plane hosts configured, an odd number is required to maintain etcd quorum",
+			},
+		},
+		{
+			name: "no control plane",
+			modify: func(cluster *pkdCluster) {
+				cluster.Controlplane.Hosts = map[string]Host{}
+			},
+			problems: []string{
+				"controlplane.hosts: at least one control plane host is required",
+			},
+		},
+		{
+			name: "host ip does not parse",
+			modify: func(cluster *pkdCluster) {
+				cluster.Controlplane.Hosts["controlplane2"] = Host{Address: "10.0.0.300"}
+				cluster.NodePools["md-0"].Hosts["worker1"] = Host{Address: "worker1.example.com"}
+			},
+			problems: []string{
+				`controlplane.hosts.controlplane2: "10.0.0.300" is not a valid IP address`,
+				`nodepools.md-0.hosts.worker1: "worker1.example.com" is not a valid IP address`,
+			},
+		},
+		{
+			name: "host ip used twice",
+			modify: func(cluster *pkdCluster) {
+				cluster.NodePools["md-0"].Hosts["worker1"] = Host{Address: "10.0.0.11"}
+			},
+			problems: []string{
+				"nodepools.md-0.hosts.worker1: 10.0.0.11 is already used by controlplane.hosts.controlplane1",
+			},
+		},
+		{
+			name: "invalid cidrs",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.PodSubnet = "192.168.0.0"
+				cluster.MetaData.ServiceSubnet = "10.96.0.0/33"
+			},
+			problems: []string{
+				`metadata.podsubnet: "192.168.0.0" is not a valid CIDR`,
+				`metadata.servicesubnet: "10.96.0.0/33" is not a valid CIDR`,
+			},
+		},
+		{
+			name: "pod and service subnets overlap",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.ServiceSubnet = "192.168.128.0/17"
+			},
+			problems: []string{
+				"metadata.servicesubnet: 192.168.128.0/17 overlaps metadata.podsubnet 192.168.0.0/16",
+			},
+		},
+		{
+			name: "pod subnet overlaps hosts",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.PodSubnet = "10.0.0.0/24"
+			},
+			problems: []string{
+				"metadata.podsubnet: 10.0.0.0/24 overlaps controlplane.hosts.controlplane1 (10.0.0.11)",
+				"metadata.podsubnet: 10.0.0.0/24 overlaps nodepools.md-0.hosts.worker3 (10.0.0.16)",
+				"metadata.kubeviploadbalancer: 10.0.0.10 is inside metadata.podsubnet 10.0.0.0/24",
+				"metadata.metaladdressrange: 10.0.0.30 is inside metadata.podsubnet 10.0.0.0/24",
+			},
+		},
+		{
+			name: "kube-vip address inside the service subnet",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.KubeVipLoadbalancer = "10.96.0.10"
+			},
+			problems: []string{
+				"metadata.kubeviploadbalancer: 10.96.0.10 is inside metadata.servicesubnet 10.96.0.0/12",
+			},
+		},
+		{
+			name: "kube-vip address used by a host",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.KubeVipLoadbalancer = "10.0.0.14"
+			},
+			problems: []string{
+				"metadata.kubeviploadbalancer: 10.0.0.14 is already used by nodepools.md-0.hosts.worker1",
+			},
+		},
+		{
+			name: "kube-vip address does not parse",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.KubeVipLoadbalancer = "vip.example.com"
+			},
+			problems: []string{
+				`metadata.kubeviploadbalancer: "vip.example.com" is not a valid IP address`,
+			},
+		},
+		{
+			name: "metal-lb range inside the pod subnet",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.MetalAddressRange = "192.168.1.10-192.168.1.20"
+			},
+			problems: []string{
+				"metadata.metaladdressrange: 192.168.1.10 is inside metadata.podsubnet 192.168.0.0/16",
+				"metadata.metaladdressrange: 192.168.1.20 is inside metadata.podsubnet 192.168.0.0/16",
+			},
+		},
+		{
+			name: "metal-lb range contains a service subnet",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.MetalAddressRange = "10.95.0.0-10.120.0.0"
+			},
+			problems: []string{
+				"metadata.metaladdressrange: 10.95.0.0-10.120.0.0 contains metadata.servicesubnet 10.96.0.0/12",
+			},
+		},
+		{
+			name: "metal-lb range contains hosts and the kube-vip address",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.MetalAddressRange = "10.0.0.5-10.0.0.15"
+			},
+			problems: []string{
+				"metadata.metaladdressrange: 10.0.0.15 is already used by nodepools.md-0.hosts.worker2",
+				"metadata.metaladdressrange: 10.0.0.5-10.0.0.15 contains controlplane.hosts.controlplane1 (10.0.0.11)",
+				"metadata.metaladdressrange: 10.0.0.5-10.0.0.15 contains metadata.kubeviploadbalancer 10.0.0.10",
+			},
+		},
+		{
+			name: "metal-lb range does not parse",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.MetalAddressRange = "10.0.0.34-10.0.0.30"
+			},
+			problems: []string{
+				`metadata.metaladdressrange: "10.0.0.34-10.0.0.30" starts after it ends`,
+			},
+		},
+		{
+			name: "every problem is reported at once",
+			modify: func(cluster *pkdCluster) {
+				cluster.MetaData.Name = ""
+				delete(cluster.Controlplane.Hosts, "controlplane3")
+				cluster.MetaData.ServiceSubnet = "192.168.128.0/17"
+			},
+			problems: []string{
+				"metadata.name: is required",
+				"controlplane.hosts: 2 control plane hosts configured, an odd number is required to maintain etcd quorum",
+				"metadata.servicesubnet: 192.168.128.0/17 overlaps metadata.podsubnet 192.168.0.0/16",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//loaded for every case, the modifications change the fixture's maps
+			cluster := loadClusterFile("testdata/ha.yaml")
+			test.modify(&cluster)
+			problems := validateCluster(cluster)
+			if len(test.problems) == 0 && len(problems) > 0 {
+				t.Fatalf("validateCluster reported\n  %s\nwant no problems", strings.Join(problems, "\n  "))
+			}
+			for _, want := range test.problems {
+				found := false
+				for _, problem := range problems {
+					if strings.HasPrefix(problem, want) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("validateCluster did not report %q, it reported\n  %s", want, strings.Join(problems, "\n  "))
+				}
+			}
+		})
+	}
+}